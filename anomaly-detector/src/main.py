@@ -51,5 +51,11 @@ for msg in consumer:
         anomalyScore = result.inferences['anomalyScore']
         if anomalyScore > 0.9:
             print 'found an anomaly (%s): %d' % (span['trace_id'], duration)
-            producer.send('interestingTraces', bytes(span['trace_id']))
+            producer.send('interestingTraces', json.dumps({
+                'trace_id': span['trace_id'],
+                'span_id': span['span_id'],
+                'entity_name': messageValue['entity_name'],
+                'reason': 'anomaly',
+                'score': anomalyScore,
+            }))
     print seen, ' spans processed'
@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"strings"
 	"time"
 
 	sdb "shared/db"
@@ -43,41 +42,24 @@ func startReader(msgChan chan st.ErrorMessage) error {
 }
 
 func main() {
-	KEYSPACE := "span_collector"
-	TABLE_NAME := KEYSPACE + ".system_errors"
-	tableSchema := map[string]string{
-		"message":   "text",
-		"stack":     "text",
-		"timestamp": "timestamp",
-		"component": "text",
-		"event":     "text",
+	openStore, err := sdb.BackendFromEnv()
+	if err != nil {
+		log.Fatal(err)
 	}
-	session, err := sdb.SetupCassandraSchema(KEYSPACE, TABLE_NAME, tableSchema, "component, timestamp")
+	store, err := openStore()
 	for err != nil {
-		log.Print("ran into an error while setting up cassandra, waiting 5 seconds: ", err)
+		log.Print("ran into an error while opening the store, waiting 5 seconds: ", err)
 		time.Sleep(5 * time.Second)
-		session, err = sdb.SetupCassandraSchema(KEYSPACE, TABLE_NAME, tableSchema, "component, timestamp")
+		store, err = openStore()
 	}
-	defer session.Close()
+	defer store.Close()
 
 	msgChan := make(chan st.ErrorMessage)
 	startReader(msgChan)
 
-	go func() {
-		for {
-			result := make(map[string]interface{})
-			session.Query("SELECT COUNT(*) FROM " + TABLE_NAME).MapScan(result)
-			log.Println("counts yo:", result)
-			time.Sleep(10 * time.Second)
-		}
-	}()
-
-	placeholderValues := []string{"?"}
 	for msg := range msgChan {
-		e := msg.Error
-		fields, errorValues := sdb.GetKeysAndValues(e)
-		query := "INSERT into " + TABLE_NAME + " (" + strings.Join(*fields, ",") + ") VALUES (" + sdb.MakePlaceholderString(&placeholderValues, len(*fields)) + ");"
-		err := session.Query(query, *errorValues...).Exec()
+		msg.Error.MessageId = msg.MessageId
+		err := store.SaveError(&msg.Error)
 		if err != nil {
 			log.Fatalln(err)
 		}
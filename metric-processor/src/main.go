@@ -6,10 +6,14 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	sc "shared/config"
 	sm "shared/message"
+	stree "shared/trace"
 	st "shared/types"
 )
 
@@ -39,9 +43,14 @@ func SendMetrics(insightsKey string, metrics *MetricList, startTime uint64, inte
 	//// set query params and headers
 	req.Header.Set("X-Insert-Key", insightsKey)
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Content-Length", string(len(body)))
+	req.Header.Set("Content-Length", strconv.Itoa(len(body)))
 	client := &http.Client{}
 	res, err := client.Do(req)
+	if err != nil {
+		response.Err = err
+		resChan <- response
+		return
+	}
 	defer res.Body.Close()
 	//bodyBytes, err2 := ioutil.ReadAll(res.Body)
 	//bodyString := string(bodyBytes)
@@ -51,9 +60,34 @@ func SendMetrics(insightsKey string, metrics *MetricList, startTime uint64, inte
 	resChan <- response
 }
 
-func consume(msgChan chan st.SpanMessage, lock *sync.RWMutex, InsightsKeyToMetrics *map[string]MetricsMap, tagWhitelist *[]string) {
+// selfTimes works out the exclusive time of every span in a message. Only
+// the spans in the message are known, so time spent in children reported by
+// other entities counts towards the caller. Self times aren't corrected for
+// clock skew: a message only holds spans from one entity, so there are no
+// calls between entities to correct.
+func selfTimes(spans []st.Span) map[string]float64 {
+	traces := make(map[string][]st.Span)
+	for _, s := range spans {
+		traces[s.TraceId] = append(traces[s.TraceId], s)
+	}
+	selfTimes := make(map[string]float64, len(spans))
+	for _, traceSpans := range traces {
+		trace := stree.Assemble(traceSpans)
+		for spanId, selfTime := range trace.SelfTimes() {
+			selfTimes[spanId] = selfTime
+		}
+	}
+	return selfTimes
+}
+
+func consume(msgChan chan st.SpanMessage, lock *sync.RWMutex, InsightsKeyToMetrics *map[string]MetricsMap, tagWhitelist *atomic.Value, emitSelfTime bool) {
 	for msg := range msgChan {
 		if msg.InsightsKey != "" {
+			whitelist := tagWhitelist.Load().([]string)
+			var spanSelfTimes map[string]float64
+			if emitSelfTime {
+				spanSelfTimes = selfTimes(msg.Spans)
+			}
 			// lock for the whole consume loop, since we will be making
 			// new metric buckets, and we don't want them to get dropped
 			// on accident. this is probably awful for performance, and
@@ -65,35 +99,18 @@ func consume(msgChan chan st.SpanMessage, lock *sync.RWMutex, InsightsKeyToMetri
 				(*InsightsKeyToMetrics)[msg.InsightsKey] = make(MetricsMap)
 				NameToMetrics = (*InsightsKeyToMetrics)[msg.InsightsKey]
 			}
-		SPAN_LOOP:
 			for _, s := range msg.Spans {
-				Metrics, ok := NameToMetrics[s.Name]
-				if !ok {
-					NameToMetrics[s.Name] = new(MetricList)
-					Metrics = NameToMetrics[s.Name]
-				}
 				// collect spans into metrics bucket
 				attrs := make(map[string]interface{})
-				for _, tagName := range *tagWhitelist {
+				for _, tagName := range whitelist {
 					if val, ok := s.Tags[tagName]; ok {
 						attrs[tagName] = val
 					}
 				}
-				duration := s.FinishTime - s.StartTime
-				for _, m := range *Metrics {
-					if m.Recognizes(attrs) {
-						m.Add(duration)
-						//log.Print(m)
-						continue SPAN_LOOP
-					}
-				}
-				metric := Metric{
-					Type:       "summary",
-					Name:       s.Name,
-					Attributes: attrs,
+				NameToMetrics.Record(s.Name, attrs, s.FinishTime-s.StartTime)
+				if selfTime, ok := spanSelfTimes[s.SpanId]; ok {
+					NameToMetrics.Record(s.Name+".self_time", attrs, selfTime)
 				}
-				metric.Add(duration)
-				*Metrics = append(*Metrics, &metric)
 			}
 			lock.Unlock()
 		} else {
@@ -107,14 +124,42 @@ func getTimestampMs() uint64 {
 	return uint64(time.Now().UnixNano() / int64(time.Millisecond))
 }
 
-func main() {
-	whitelistJSON, err := ioutil.ReadFile("/conf/whitelist.json")
+// loadWhitelist reads the list of tags to keep as metric attributes.
+func loadWhitelist(path string) ([]string, error) {
+	whitelistJSON, err := ioutil.ReadFile(path)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	tagWhitelist := make([]string, 0)
-	json.Unmarshal(whitelistJSON, &tagWhitelist)
+	if err := json.Unmarshal(whitelistJSON, &tagWhitelist); err != nil {
+		return nil, err
+	}
+	return tagWhitelist, nil
+}
+
+func main() {
+	errHandler := sm.NewErrorHandler("metric-processor")
+
+	// the whitelist is swapped out whenever the config changes
+	var tagWhitelist atomic.Value
+	storeWhitelist := func(path string) error {
+		whitelist, err := loadWhitelist(path)
+		if err != nil {
+			return err
+		}
+		tagWhitelist.Store(whitelist)
+		return nil
+	}
+	whitelistPath := sc.String("WHITELIST_CONFIG", "/conf/whitelist.json")
+	if err := storeWhitelist(whitelistPath); err != nil {
+		log.Fatal(err)
+	}
+	whitelistWatcher := sc.NewWatcher(whitelistPath, sc.Duration("CONFIG_POLL_INTERVAL", 10*time.Second), storeWhitelist, func(err error) {
+		noMessage := ""
+		errHandler.HandleErr(&noMessage, err, "reload")
+	})
+	go whitelistWatcher.Start()
 
 	reader := sm.NewSpanMessageConsumer("metric-consumers")
 	msgChan := make(chan st.SpanMessage)
@@ -129,7 +174,7 @@ func main() {
 	startTime := uint64(time.Now().UnixNano() / int64(time.Millisecond))
 
 	// kick off a gorouting responsible for reading messages in from kafka
-	go consume(msgChan, &lock, &InsightsKeyToMetrics, &tagWhitelist)
+	go consume(msgChan, &lock, &InsightsKeyToMetrics, &tagWhitelist, sc.String("EMIT_SELF_TIME", "true") == "true")
 
 	for {
 		if len(InsightsKeyToMetrics) > 0 {
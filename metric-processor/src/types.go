@@ -49,6 +49,29 @@ type MetricList []*Metric
 // Metric name -> Metric list
 type MetricsMap map[string]*MetricList
 
+// Record adds a value to the metric with the given name and attributes,
+// making the metric if it doesn't exist yet.
+func (mm MetricsMap) Record(name string, attrs map[string]interface{}, value float64) {
+	Metrics, ok := mm[name]
+	if !ok {
+		mm[name] = new(MetricList)
+		Metrics = mm[name]
+	}
+	for _, m := range *Metrics {
+		if m.Recognizes(attrs) {
+			m.Add(value)
+			return
+		}
+	}
+	metric := Metric{
+		Type:       "summary",
+		Name:       name,
+		Attributes: attrs,
+	}
+	metric.Add(value)
+	*Metrics = append(*Metrics, &metric)
+}
+
 type RequestResult struct {
 	Err error
 }
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	sdb "shared/db"
+)
+
+func main() {
+	printSchema := flag.Bool("schema", false, "print the schema the tables should have, going by their structs, and exit")
+	flag.Parse()
+
+	if *printSchema {
+		for _, table := range sdb.TABLES {
+			fmt.Println(table.Schema())
+		}
+		return
+	}
+
+	cassandra := sdb.NewCassandraConfigFromEnv()
+	replication, err := cassandra.Replication()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	session, err := sdb.ConnectWithoutKeyspace(cassandra)
+	for err != nil {
+		log.Print("ran into an error while connecting to cassandra, waiting 5 seconds: ", err)
+		time.Sleep(5 * time.Second)
+		session, err = sdb.ConnectWithoutKeyspace(cassandra)
+	}
+	defer session.Close()
+
+	if err := sdb.Migrate(session, sdb.KEYSPACE, replication, sdb.MIGRATIONS); err != nil {
+		log.Fatal(err)
+	}
+	if err := sdb.VerifyTables(session, sdb.KEYSPACE, sdb.TABLES); err != nil {
+		log.Fatal(err)
+	}
+	log.Print("schema for ", sdb.KEYSPACE, " is up to date")
+}
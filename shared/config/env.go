@@ -0,0 +1,62 @@
+package shared
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// String reads a setting from the environment, falling back to def when it
+// is not set.
+func String(name string, def string) string {
+	if val, ok := os.LookupEnv(name); ok && val != "" {
+		return val
+	}
+	return def
+}
+
+// Duration reads a setting like "30s" or "5m" from the environment, falling
+// back to def when it is not set or can't be parsed.
+func Duration(name string, def time.Duration) time.Duration {
+	val, ok := os.LookupEnv(name)
+	if !ok || val == "" {
+		return def
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		log.Printf("invalid duration for %s (%s), using %s", name, err, def)
+		return def
+	}
+	return d
+}
+
+// Int reads an integer setting from the environment, falling back to def
+// when it is not set or can't be parsed.
+func Int(name string, def int) int {
+	val, ok := os.LookupEnv(name)
+	if !ok || val == "" {
+		return def
+	}
+	i, err := strconv.Atoi(val)
+	if err != nil {
+		log.Printf("invalid integer for %s (%s), using %d", name, err, def)
+		return def
+	}
+	return i
+}
+
+// Float reads a decimal setting from the environment, falling back to def
+// when it is not set or can't be parsed.
+func Float(name string, def float64) float64 {
+	val, ok := os.LookupEnv(name)
+	if !ok || val == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		log.Printf("invalid number for %s (%s), using %f", name, err, def)
+		return def
+	}
+	return f
+}
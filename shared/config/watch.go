@@ -0,0 +1,69 @@
+package shared
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Watcher reloads a config file whenever it changes on disk, or the process
+// gets a SIGHUP. Load should only swap in the new config once it has
+// validated it, so a bad file leaves the previous config in place.
+type Watcher struct {
+	Path     string
+	Interval time.Duration
+	load     func(path string) error
+	onError  func(err error)
+	modTime  time.Time
+}
+
+func NewWatcher(path string, interval time.Duration, load func(path string) error, onError func(err error)) *Watcher {
+	return &Watcher{
+		Path:     path,
+		Interval: interval,
+		load:     load,
+		onError:  onError,
+	}
+}
+
+func (w *Watcher) Start() {
+	if info, err := os.Stat(w.Path); err == nil {
+		w.modTime = info.ModTime()
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hup:
+			log.Printf("got SIGHUP, reloading %s", w.Path)
+			w.reload()
+		case <-ticker.C:
+			info, err := os.Stat(w.Path)
+			if err != nil {
+				// keep going with what we have, it may be mid replace
+				continue
+			}
+			if info.ModTime().Equal(w.modTime) {
+				continue
+			}
+			w.modTime = info.ModTime()
+			log.Printf("%s changed, reloading", w.Path)
+			w.reload()
+		}
+	}
+}
+
+func (w *Watcher) reload() {
+	if err := w.load(w.Path); err != nil {
+		log.Printf("could not reload %s, keeping the previous config: %s", w.Path, err)
+		w.onError(err)
+		return
+	}
+	log.Printf("reloaded %s", w.Path)
+}
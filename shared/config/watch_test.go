@@ -0,0 +1,57 @@
+package shared
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatcherReloads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watcher")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "conf.json")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("good"), 0644))
+
+	loaded := make(chan string, 1)
+	failed := make(chan error, 1)
+	load := func(path string) error {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if string(contents) != "good" {
+			return errors.New("bad config")
+		}
+		loaded <- string(contents)
+		return nil
+	}
+	w := NewWatcher(path, 10*time.Millisecond, load, func(err error) {
+		failed <- err
+	})
+	go w.Start()
+	time.Sleep(50 * time.Millisecond)
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("bad"), 0644))
+	assert.Nil(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Second)))
+	select {
+	case err := <-failed:
+		assert.Equal(t, err.Error(), "bad config", "should report invalid configs")
+	case <-time.After(time.Second):
+		t.Error("bad config was not reported")
+	}
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("good"), 0644))
+	assert.Nil(t, os.Chtimes(path, time.Now(), time.Now().Add(2*time.Second)))
+	select {
+	case contents := <-loaded:
+		assert.Equal(t, contents, "good", "should load the changed config")
+	case <-time.After(time.Second):
+		t.Error("changed config was not loaded")
+	}
+}
@@ -0,0 +1,121 @@
+package shared
+
+import (
+	"reflect"
+
+	"github.com/gocql/gocql"
+)
+
+// Cassandra rejects batches over 50KB by default
+var DEFAULT_BATCH_BYTES int = 32 * 1024
+
+type pendingBatch struct {
+	batch *gocql.Batch
+	size  int
+}
+
+// Batcher groups statements into unlogged batches by partition key, so each
+// batch only touches one partition, and flushes a partition's batch before it
+// grows past MaxBytes. Statements too big to share a batch are run alone.
+type Batcher struct {
+	MaxBytes int
+	session  *gocql.Session
+	batches  map[string]*pendingBatch
+}
+
+func NewBatcher(session *gocql.Session, maxBytes int) *Batcher {
+	return &Batcher{
+		MaxBytes: maxBytes,
+		session:  session,
+		batches:  make(map[string]*pendingBatch),
+	}
+}
+
+// Add queues a statement for the given partition. Any error is from
+// flushing statements that were already queued, or from running this one
+// alone.
+func (b *Batcher) Add(partitionKey string, stmt string, values ...interface{}) error {
+	size := len(stmt) + EstimateSize(values...)
+	if size > b.MaxBytes {
+		return b.session.Query(stmt, values...).Exec()
+	}
+
+	var err error
+	pending, ok := b.batches[partitionKey]
+	if ok && pending.size+size > b.MaxBytes {
+		err = b.flush(partitionKey)
+		ok = false
+	}
+	if !ok {
+		pending = &pendingBatch{batch: gocql.NewBatch(gocql.UnloggedBatch)}
+		b.batches[partitionKey] = pending
+	}
+	pending.batch.Query(stmt, values...)
+	pending.size += size
+	return err
+}
+
+func (b *Batcher) flush(partitionKey string) error {
+	pending := b.batches[partitionKey]
+	delete(b.batches, partitionKey)
+	return b.session.ExecuteBatch(pending.batch)
+}
+
+// Flush runs every queued batch, giving back any errors.
+func (b *Batcher) Flush() []error {
+	errs := make([]error, 0)
+	for partitionKey := range b.batches {
+		if err := b.flush(partitionKey); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// EstimateSize gives a rough idea of how many bytes values take up in a
+// statement.
+func EstimateSize(values ...interface{}) int {
+	size := 0
+	for _, v := range values {
+		size += estimateValueSize(reflect.ValueOf(v))
+	}
+	return size
+}
+
+func estimateValueSize(v reflect.Value) int {
+	switch v.Kind() {
+	case reflect.Invalid:
+		return 0
+	case reflect.String:
+		return v.Len()
+	case reflect.Bool, reflect.Int8, reflect.Uint8:
+		return 1
+	case reflect.Int16, reflect.Uint16:
+		return 2
+	case reflect.Int32, reflect.Uint32, reflect.Float32:
+		return 4
+	case reflect.Map:
+		size := 0
+		iter := v.MapRange()
+		for iter.Next() {
+			size += estimateValueSize(iter.Key()) + estimateValueSize(iter.Value())
+		}
+		return size
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return v.Len()
+		}
+		size := 0
+		for i := 0; i < v.Len(); i++ {
+			size += estimateValueSize(v.Index(i))
+		}
+		return size
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return 0
+		}
+		return estimateValueSize(v.Elem())
+	}
+	// 64 bit numbers, timestamps and anything else
+	return 8
+}
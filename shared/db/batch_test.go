@@ -0,0 +1,16 @@
+package shared
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEstimateSize(t *testing.T) {
+	assert.Equal(t, EstimateSize("abcd", true, float64(1), int32(1)), 4+1+8+4)
+	assert.Equal(t, EstimateSize(map[string]string{"db.statement": strings.Repeat("x", 100)}), 12+100, "should count map keys and values")
+	assert.Equal(t, EstimateSize([]string{"a", "bc"}, []byte("abc")), 3+3)
+	assert.Equal(t, EstimateSize(time.Now(), nil), 8)
+}
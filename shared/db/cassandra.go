@@ -2,9 +2,8 @@ package shared
 
 import (
 	"errors"
-	"log"
+	"fmt"
 	"reflect"
-	"strings"
 
 	"github.com/gocql/gocql"
 )
@@ -18,43 +17,37 @@ func MakePlaceholderString(cachedStrings *[]string, wanted int) string {
 	return sliceVal[wanted-1]
 }
 
-func SetupCassandraSchema(keyspace string, tableName string, tableSchema map[string]string, primaryKeys string) (*gocql.Session, error) {
-	cluster := gocql.NewCluster("cassandra")
+// Connect opens a session on keyspace once the migrator has brought its
+// schema up to date.
+func Connect(config *CassandraConfig, keyspace string) (*gocql.Session, error) {
+	cluster := config.Cluster()
+	cluster.Keyspace = keyspace
 	session, err := cluster.CreateSession()
-
 	if err != nil {
 		return nil, err
 	}
 
-	defer session.Close()
-
-	if err := createKeyspace(session, keyspace); err != nil {
-		log.Print("from create ks")
-		return nil, err
+	pending, err := PendingMigrations(session, keyspace, MIGRATIONS)
+	if err == nil && len(pending) > 0 {
+		err = fmt.Errorf("%d migrations still need to be run on %s", len(pending), keyspace)
+	}
+	if err == nil {
+		err = VerifyTables(session, keyspace, TABLES)
 	}
-	if err := createSpanTable(session, tableName, tableSchema, primaryKeys); err != nil {
-		log.Print("from create table")
+	if err != nil {
+		session.Close()
 		return nil, err
 	}
-	cluster.Consistency = gocql.One
-	cluster.Keyspace = keyspace
-
-	return cluster.CreateSession()
+	return session, nil
 }
 
-func createKeyspace(session *gocql.Session, keyspace string) error {
-	query := "CREATE KEYSPACE IF NOT EXISTS " + keyspace + " WITH REPLICATION = {'class': 'SimpleStrategy', 'replication_factor': 1};"
-	return session.Query(query).Exec()
+// ConnectWithoutKeyspace is for setting up keyspaces.
+func ConnectWithoutKeyspace(config *CassandraConfig) (*gocql.Session, error) {
+	return config.Cluster().CreateSession()
 }
 
-func createSpanTable(session *gocql.Session, tableName string, tableSchema map[string]string, primaryKeys string) error {
-	fieldSchema := make([]string, len(tableSchema))
-	idx := 0
-	for fieldName, fieldType := range tableSchema {
-		fieldSchema[idx] = fieldName + " " + fieldType
-		idx++
-	}
-	query := "CREATE TABLE IF NOT EXISTS " + tableName + " (" + strings.Join(fieldSchema, ", ") + ", PRIMARY KEY(" + primaryKeys + "));"
+func createKeyspace(session *gocql.Session, keyspace string, replication string) error {
+	query := "CREATE KEYSPACE IF NOT EXISTS " + keyspace + " WITH REPLICATION = " + replication + ";"
 	return session.Query(query).Exec()
 }
 
@@ -68,6 +61,7 @@ func ParseRow(dest interface{}, row map[string]interface{}) (error, interface{})
 		if !ok {
 			continue
 		}
+		cTag, _ = parseTag(cTag)
 		cassVal := reflect.ValueOf(row[cTag])
 		if cassVal.IsValid() {
 			resVal.FieldByName(field.Name).Set(cassVal.Convert(field.Type))
@@ -91,6 +85,7 @@ func GetKeysAndValues(source interface{}) (*[]string, *[]interface{}) {
 		if !ok || !bos.IsValid() {
 			continue
 		}
+		cTag, _ = parseTag(cTag)
 
 		fields = append(fields, cTag)
 		values = append(values, bos.Interface())
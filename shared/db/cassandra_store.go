@@ -0,0 +1,386 @@
+package shared
+
+import (
+	"log"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	sc "shared/config"
+	st "shared/types"
+
+	"github.com/gocql/gocql"
+)
+
+var SPANS_TABLE string = KEYSPACE + ".spans"
+var SELECTIONS_TABLE string = KEYSPACE + ".interesting_traces"
+
+// selections of traces the janitor is done with, so the trace browser can
+// still say why they were kept
+var SELECTION_ARCHIVE_TABLE string = KEYSPACE + ".selection_archive"
+var EXPORT_STATUS_TABLE string = KEYSPACE + ".export_status"
+var ERRORS_TABLE string = KEYSPACE + ".system_errors"
+
+// lookup tables for finding spans without scanning
+var SPANS_BY_ENTITY_TABLE string = KEYSPACE + ".spans_by_entity"
+var SPANS_BY_NAME_TABLE string = KEYSPACE + ".spans_by_name"
+var SPANS_BY_TAG_TABLE string = KEYSPACE + ".spans_by_tag"
+var SPAN_NAMES_TABLE string = KEYSPACE + ".span_names"
+
+var DEFAULT_TAG_BYTES int = 4096
+
+// CassandraStore implements every store on top of the span_collector
+// keyspace.
+type CassandraStore struct {
+	session *gocql.Session
+	// spans are written in batches under BatchBytes, spans too big for a
+	// batch on their own have their tags cut down to MaxTagBytes
+	BatchBytes  int
+	MaxTagBytes int
+	// consistency for reads, writes use the session's default
+	ReadConsistency gocql.Consistency
+}
+
+func init() {
+	RegisterBackend("cassandra", func() (Store, error) {
+		config := NewCassandraConfigFromEnv()
+		session, err := Connect(config, KEYSPACE)
+		if err != nil {
+			return nil, err
+		}
+		store := NewCassandraStore(session)
+		store.BatchBytes = sc.Int("BATCH_MAX_BYTES", DEFAULT_BATCH_BYTES)
+		store.MaxTagBytes = sc.Int("MAX_TAG_BYTES", DEFAULT_TAG_BYTES)
+		store.ReadConsistency = config.ReadConsistency
+		return store, nil
+	})
+}
+
+func NewCassandraStore(session *gocql.Session) *CassandraStore {
+	return &CassandraStore{
+		session:         session,
+		BatchBytes:      DEFAULT_BATCH_BYTES,
+		MaxTagBytes:     DEFAULT_TAG_BYTES,
+		ReadConsistency: gocql.One,
+	}
+}
+
+// selectColumns lists the columns to select to fill in a struct of source's
+// type.
+func selectColumns(source interface{}) string {
+	columns := columnsOf(reflect.TypeOf(source), nil)
+	names := make([]string, len(columns))
+	for i, c := range columns {
+		names[i] = c.name
+	}
+	return strings.Join(names, ", ")
+}
+
+// scanTargets points at the fields of dest (a pointer to a struct) in the
+// same order as selectColumns.
+func scanTargets(dest interface{}) []interface{} {
+	destVal := reflect.ValueOf(dest).Elem()
+	columns := columnsOf(destVal.Type(), nil)
+	targets := make([]interface{}, len(columns))
+	for i, c := range columns {
+		targets[i] = destVal.FieldByIndex(c.index).Addr().Interface()
+	}
+	return targets
+}
+
+func (c *CassandraStore) Close() {
+	c.session.Close()
+}
+
+func (c *CassandraStore) read(stmt string, values ...interface{}) *gocql.Query {
+	return c.session.Query(stmt, values...).Consistency(c.ReadConsistency)
+}
+
+// WriteSpans batches spans by trace, so every batch stays on one partition
+// and can go unlogged.
+func (c *CassandraStore) WriteSpans(rows []st.SpanRow, ttl int) []error {
+	insert := InsertFor(st.SpanRow{}, SPANS_TABLE, true)
+	batcher := NewBatcher(c.session, c.BatchBytes)
+	errs := make([]error, 0)
+	for _, row := range rows {
+		values := insert.Values(row, ttl)
+		if len(insert.Statement)+EstimateSize(values...) > c.BatchBytes && row.TruncateTags(c.MaxTagBytes) {
+			log.Printf("truncated tags on span %s in trace %s", row.SpanId, row.TraceId)
+			values = insert.Values(row, ttl)
+		}
+		if err := batcher.Add(row.TraceId, insert.Statement, values...); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return append(errs, batcher.Flush()...)
+}
+
+func (c *CassandraStore) TraceSpans(traceId string) ([]st.SpanRow, error) {
+	iter := c.read("SELECT "+selectColumns(st.SpanRow{})+" FROM "+SPANS_TABLE+" WHERE trace_id = ?", traceId).Iter()
+	rows := make([]st.SpanRow, 0)
+	var row st.SpanRow
+	for iter.Scan(scanTargets(&row)...) {
+		rows = append(rows, row)
+		row = st.SpanRow{}
+	}
+	return rows, iter.Close()
+}
+
+func (c *CassandraStore) CountSpans(traceId string) (int, error) {
+	var count int
+	err := c.read("SELECT COUNT(*) FROM "+SPANS_TABLE+" WHERE trace_id = ?", traceId).Scan(&count)
+	return count, err
+}
+
+// IndexSpans batches rows by the partition they are going to.
+func (c *CassandraStore) IndexSpans(spans []st.SpanSummary, tags []st.TaggedSpanSummary, ttl int) []error {
+	byEntity := InsertFor(st.SpanSummary{}, SPANS_BY_ENTITY_TABLE, true)
+	byName := InsertFor(st.SpanSummary{}, SPANS_BY_NAME_TABLE, true)
+	byTag := InsertFor(st.TaggedSpanSummary{}, SPANS_BY_TAG_TABLE, true)
+	names := InsertFor(st.SpanName{}, SPAN_NAMES_TABLE, true)
+
+	batcher := NewBatcher(c.session, c.BatchBytes)
+	errs := make([]error, 0)
+	add := func(partitionKey string, insert *Insert, source interface{}) {
+		if err := batcher.Add(partitionKey, insert.Statement, insert.Values(source, ttl)...); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	seenNames := make(map[st.SpanName]bool)
+	for _, span := range spans {
+		hour := strconv.FormatInt(span.Hour, 10)
+		add(SPANS_BY_ENTITY_TABLE+"/"+span.EntityName+"/"+hour, byEntity, span)
+		add(SPANS_BY_NAME_TABLE+"/"+span.Name+"/"+hour, byName, span)
+		name := st.SpanName{EntityName: span.EntityName, Name: span.Name}
+		if !seenNames[name] {
+			seenNames[name] = true
+			add(SPAN_NAMES_TABLE+"/"+span.EntityName, names, name)
+		}
+	}
+	for _, tag := range tags {
+		add(SPANS_BY_TAG_TABLE+"/"+tag.Tag+"/"+tag.Value+"/"+strconv.FormatInt(tag.Hour, 10), byTag, tag)
+	}
+	return append(errs, batcher.Flush()...)
+}
+
+func (c *CassandraStore) FindSpans(lookup Lookup, hour int64, from float64, to float64, limit int) ([]st.SpanSummary, error) {
+	where, values := lookup.partition(hour)
+	iter := c.read(
+		"SELECT "+selectColumns(st.SpanSummary{})+" FROM "+lookup.table()+" WHERE "+where+" AND start_time >= ? AND start_time <= ? LIMIT ?",
+		append(values, from, to, limit)...,
+	).Iter()
+	spans := make([]st.SpanSummary, 0)
+	var span st.SpanSummary
+	for iter.Scan(scanTargets(&span)...) {
+		spans = append(spans, span)
+	}
+	return spans, iter.Close()
+}
+
+func (c *CassandraStore) Entities() ([]string, error) {
+	iter := c.read("SELECT DISTINCT entity_name FROM " + SPAN_NAMES_TABLE).Iter()
+	entities := make([]string, 0)
+	var entity string
+	for iter.Scan(&entity) {
+		entities = append(entities, entity)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	sort.Strings(entities)
+	return entities, nil
+}
+
+func (c *CassandraStore) SpanNames(entityName string) ([]string, error) {
+	iter := c.read("SELECT name FROM "+SPAN_NAMES_TABLE+" WHERE entity_name = ?", entityName).Iter()
+	names := make([]string, 0)
+	var name string
+	for iter.Scan(&name) {
+		names = append(names, name)
+	}
+	return names, iter.Close()
+}
+
+func (c *CassandraStore) SaveSelections(traces []*st.InterestingTrace, ttl int) error {
+	if len(traces) == 0 {
+		return nil
+	}
+	insert := InsertFor(st.InterestingTrace{}, SELECTIONS_TABLE, true)
+	if len(traces) == 1 {
+		return insert.Query(c.session, *traces[0], ttl).Exec()
+	}
+	batch := gocql.NewBatch(gocql.LoggedBatch)
+	for _, trace := range traces {
+		batch.Query(insert.Statement, insert.Values(*trace, ttl)...)
+	}
+	return c.session.ExecuteBatch(batch)
+}
+
+func (c *CassandraStore) HasSelection(traceId string, reason string) (bool, error) {
+	var found string
+	err := c.read("SELECT reason FROM "+SELECTIONS_TABLE+" WHERE trace_id = ? AND reason = ?", traceId, reason).Scan(&found)
+	if err == gocql.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (c *CassandraStore) Selections() ([]st.InterestingTrace, error) {
+	iter := c.read("SELECT " + selectColumns(st.InterestingTrace{}) + " FROM " + SELECTIONS_TABLE).Iter()
+	traces := make([]st.InterestingTrace, 0)
+	var trace st.InterestingTrace
+	for iter.Scan(scanTargets(&trace)...) {
+		traces = append(traces, trace)
+	}
+	return traces, iter.Close()
+}
+
+func (c *CassandraStore) traceSelections(table string, traceId string) ([]st.InterestingTrace, error) {
+	iter := c.read("SELECT "+selectColumns(st.InterestingTrace{})+" FROM "+table+" WHERE trace_id = ?", traceId).Iter()
+	traces := make([]st.InterestingTrace, 0)
+	var trace st.InterestingTrace
+	for iter.Scan(scanTargets(&trace)...) {
+		traces = append(traces, trace)
+	}
+	return traces, iter.Close()
+}
+
+func (c *CassandraStore) TraceSelections(traceId string) ([]st.InterestingTrace, error) {
+	live, err := c.traceSelections(SELECTIONS_TABLE, traceId)
+	if err != nil {
+		return nil, err
+	}
+	archived, err := c.traceSelections(SELECTION_ARCHIVE_TABLE, traceId)
+	if err != nil {
+		return nil, err
+	}
+	return mergeSelections(live, archived), nil
+}
+
+func (c *CassandraStore) DeleteSelection(traceId string, reason string) error {
+	return c.session.Query("DELETE FROM "+SELECTIONS_TABLE+" WHERE trace_id = ? AND reason = ?", traceId, reason).Exec()
+}
+
+// ArchiveTrace copies the trace's selections and drops them from the
+// interesting set in one logged batch, so they aren't lost half way.
+func (c *CassandraStore) ArchiveTrace(traceId string, ttl int) error {
+	live, err := c.traceSelections(SELECTIONS_TABLE, traceId)
+	if err != nil {
+		return err
+	}
+	insert := InsertFor(st.InterestingTrace{}, SELECTION_ARCHIVE_TABLE, true)
+	batch := gocql.NewBatch(gocql.LoggedBatch)
+	for _, trace := range live {
+		batch.Query(insert.Statement, insert.Values(trace, ttl)...)
+	}
+	batch.Query("DELETE FROM "+SELECTIONS_TABLE+" WHERE trace_id = ?", traceId)
+	return c.session.ExecuteBatch(batch)
+}
+
+func (c *CassandraStore) ExportStatus(traceId string, destination string) (*st.ExportStatus, error) {
+	status := st.ExportStatus{}
+	err := c.read(
+		"SELECT "+selectColumns(status)+" FROM "+EXPORT_STATUS_TABLE+" WHERE trace_id = ? AND destination = ?",
+		traceId,
+		destination,
+	).Scan(scanTargets(&status)...)
+	if err == gocql.ErrNotFound {
+		return st.NewExportStatus(traceId, destination), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+func (c *CassandraStore) ExportStatuses(traceId string) ([]st.ExportStatus, error) {
+	iter := c.read("SELECT "+selectColumns(st.ExportStatus{})+" FROM "+EXPORT_STATUS_TABLE+" WHERE trace_id = ?", traceId).Iter()
+	statuses := make([]st.ExportStatus, 0)
+	var status st.ExportStatus
+	for iter.Scan(scanTargets(&status)...) {
+		statuses = append(statuses, status)
+		status = st.ExportStatus{}
+	}
+	return statuses, iter.Close()
+}
+
+func (c *CassandraStore) SaveExportStatus(status *st.ExportStatus, ttl int) error {
+	return InsertFor(st.ExportStatus{}, EXPORT_STATUS_TABLE, true).Query(c.session, *status, ttl).Exec()
+}
+
+func (c *CassandraStore) SaveError(e *st.Error) error {
+	return InsertFor(st.Error{}, ERRORS_TABLE, false).Query(c.session, *e).Exec()
+}
+
+// errorComponents lists the partitions of the errors table worth reading.
+func (c *CassandraStore) errorComponents(filter ErrorFilter) ([]string, error) {
+	if filter.Component != "" {
+		return []string{filter.Component}, nil
+	}
+	iter := c.read("SELECT DISTINCT component FROM " + ERRORS_TABLE).Iter()
+	components := make([]string, 0)
+	var component string
+	for iter.Scan(&component) {
+		components = append(components, component)
+	}
+	return components, iter.Close()
+}
+
+// scanErrors calls found with each of a component's errors that match the
+// filter, most recent first, until it returns false. Events and message ids
+// aren't part of the key, so they are checked here rather than by Cassandra.
+func (c *CassandraStore) scanErrors(component string, filter ErrorFilter, found func(e st.Error) bool) error {
+	iter := c.read(
+		"SELECT "+selectColumns(st.Error{})+" FROM "+ERRORS_TABLE+" WHERE component = ? AND timestamp >= ? AND timestamp <= ? ORDER BY timestamp DESC",
+		component,
+		filter.From,
+		filter.To,
+	).Iter()
+	var e st.Error
+	for iter.Scan(scanTargets(&e)...) {
+		if filter.matches(e) && !found(e) {
+			break
+		}
+	}
+	return iter.Close()
+}
+
+func (c *CassandraStore) FindErrors(filter ErrorFilter) ([]st.Error, error) {
+	components, err := c.errorComponents(filter)
+	if err != nil {
+		return nil, err
+	}
+	errs := make([]st.Error, 0)
+	for _, component := range components {
+		// each component's newest errors could be the newest overall
+		found := 0
+		err := c.scanErrors(component, filter, func(e st.Error) bool {
+			errs = append(errs, e)
+			found++
+			return filter.Limit <= 0 || found < filter.Limit
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return newestErrors(errs, filter.Limit), nil
+}
+
+func (c *CassandraStore) ErrorCounts(filter ErrorFilter) (map[string]int, error) {
+	components, err := c.errorComponents(filter)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int)
+	for _, component := range components {
+		err := c.scanErrors(component, filter, func(e st.Error) bool {
+			counts[component]++
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return counts, nil
+}
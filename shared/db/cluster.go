@@ -0,0 +1,153 @@
+package shared
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	sc "shared/config"
+
+	"github.com/gocql/gocql"
+)
+
+// CassandraConfig is how to reach the cluster, and how keyspaces created on
+// it are replicated.
+type CassandraConfig struct {
+	Hosts    []string
+	Username string
+	Password string
+
+	TLS      bool
+	CaPath   string
+	CertPath string
+	KeyPath  string
+	// skips checking the server certificate altogether, both its chain and
+	// its host name
+	InsecureSkipVerify bool
+
+	// SimpleStrategy uses ReplicationFactor, NetworkTopologyStrategy uses
+	// the factor given for each datacenter
+	ReplicationStrategy string
+	ReplicationFactor   int
+	Datacenters         map[string]int
+
+	// reads are made at ReadConsistency by the CassandraStore, writes use
+	// the session's default of WriteConsistency
+	ReadConsistency  gocql.Consistency
+	WriteConsistency gocql.Consistency
+}
+
+// NewCassandraConfigFromEnv reads the cluster settings from CASSANDRA_*
+// variables. Anything malformed is logged and left at its default.
+func NewCassandraConfigFromEnv() *CassandraConfig {
+	return &CassandraConfig{
+		Hosts:               parseHosts(sc.String("CASSANDRA_HOSTS", "cassandra")),
+		Username:            sc.String("CASSANDRA_USERNAME", ""),
+		Password:            sc.String("CASSANDRA_PASSWORD", ""),
+		TLS:                 sc.String("CASSANDRA_TLS", "false") == "true",
+		CaPath:              sc.String("CASSANDRA_TLS_CA", ""),
+		CertPath:            sc.String("CASSANDRA_TLS_CERT", ""),
+		KeyPath:             sc.String("CASSANDRA_TLS_KEY", ""),
+		InsecureSkipVerify:  sc.String("CASSANDRA_TLS_INSECURE_SKIP_VERIFY", "false") == "true",
+		ReplicationStrategy: sc.String("CASSANDRA_REPLICATION_STRATEGY", "SimpleStrategy"),
+		ReplicationFactor:   sc.Int("CASSANDRA_REPLICATION_FACTOR", 1),
+		Datacenters:         ParseDatacenters(sc.String("CASSANDRA_DATACENTERS", "")),
+		ReadConsistency:     parseConsistency("CASSANDRA_READ_CONSISTENCY", gocql.One),
+		WriteConsistency:    parseConsistency("CASSANDRA_WRITE_CONSISTENCY", gocql.One),
+	}
+}
+
+func parseHosts(hosts string) []string {
+	parsed := make([]string, 0)
+	for _, host := range strings.Split(hosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			parsed = append(parsed, host)
+		}
+	}
+	return parsed
+}
+
+func parseConsistency(name string, def gocql.Consistency) gocql.Consistency {
+	val := sc.String(name, "")
+	if val == "" {
+		return def
+	}
+	consistency, err := gocql.ParseConsistencyWrapper(strings.ToUpper(val))
+	if err != nil {
+		log.Printf("invalid consistency for %s (%s), using %s", name, err, def)
+		return def
+	}
+	return consistency
+}
+
+// ParseDatacenters reads replication factors per datacenter, formatted like
+// "dc1=3,dc2=2".
+func ParseDatacenters(datacenters string) map[string]int {
+	factors := make(map[string]int)
+	for _, dc := range strings.Split(datacenters, ",") {
+		dc = strings.TrimSpace(dc)
+		if dc == "" {
+			continue
+		}
+		parts := strings.SplitN(dc, "=", 2)
+		if len(parts) != 2 {
+			log.Printf("ignoring malformed datacenter %q", dc)
+			continue
+		}
+		factor, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil {
+			log.Printf("ignoring malformed datacenter %q: %s", dc, err)
+			continue
+		}
+		factors[strings.TrimSpace(parts[0])] = factor
+	}
+	return factors
+}
+
+// Replication gives the replication map used when creating keyspaces.
+func (c *CassandraConfig) Replication() (string, error) {
+	switch c.ReplicationStrategy {
+	case "SimpleStrategy":
+		return fmt.Sprintf("{'class': 'SimpleStrategy', 'replication_factor': %d}", c.ReplicationFactor), nil
+	case "NetworkTopologyStrategy":
+		if len(c.Datacenters) == 0 {
+			return "", fmt.Errorf("NetworkTopologyStrategy needs at least one datacenter")
+		}
+		names := make([]string, 0, len(c.Datacenters))
+		for name := range c.Datacenters {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		factors := make([]string, len(names))
+		for i, name := range names {
+			factors[i] = fmt.Sprintf("'%s': %d", name, c.Datacenters[name])
+		}
+		return "{'class': 'NetworkTopologyStrategy', " + strings.Join(factors, ", ") + "}", nil
+	}
+	return "", fmt.Errorf("unknown replication strategy %s", c.ReplicationStrategy)
+}
+
+// Cluster builds the gocql config, with writes using WriteConsistency by
+// default.
+func (c *CassandraConfig) Cluster() *gocql.ClusterConfig {
+	cluster := gocql.NewCluster(c.Hosts...)
+	cluster.Consistency = c.WriteConsistency
+	if c.Username != "" {
+		cluster.Authenticator = gocql.PasswordAuthenticator{
+			Username: c.Username,
+			Password: c.Password,
+		}
+	}
+	if c.TLS {
+		// without host verification gocql skips verifying the chain too
+		cluster.SslOpts = &gocql.SslOptions{
+			CaPath:                 c.CaPath,
+			CertPath:               c.CertPath,
+			KeyPath:                c.KeyPath,
+			EnableHostVerification: !c.InsecureSkipVerify,
+		}
+	}
+	return cluster
+}
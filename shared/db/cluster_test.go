@@ -0,0 +1,54 @@
+package shared
+
+import (
+	"os"
+	"testing"
+
+	"github.com/gocql/gocql"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCassandraConfigFromEnv(t *testing.T) {
+	os.Setenv("CASSANDRA_HOSTS", "cass-1, cass-2,")
+	os.Setenv("CASSANDRA_READ_CONSISTENCY", "local_quorum")
+	os.Setenv("CASSANDRA_WRITE_CONSISTENCY", "nonsense")
+	defer os.Unsetenv("CASSANDRA_HOSTS")
+	defer os.Unsetenv("CASSANDRA_READ_CONSISTENCY")
+	defer os.Unsetenv("CASSANDRA_WRITE_CONSISTENCY")
+
+	config := NewCassandraConfigFromEnv()
+	assert.Equal(t, config.Hosts, []string{"cass-1", "cass-2"})
+	assert.Equal(t, config.ReadConsistency, gocql.LocalQuorum)
+	assert.Equal(t, config.WriteConsistency, gocql.One, "should fall back when the consistency is malformed")
+}
+
+func TestReplication(t *testing.T) {
+	config := &CassandraConfig{ReplicationStrategy: "SimpleStrategy", ReplicationFactor: 3}
+	replication, err := config.Replication()
+	assert.Nil(t, err)
+	assert.Equal(t, replication, "{'class': 'SimpleStrategy', 'replication_factor': 3}")
+
+	config = &CassandraConfig{
+		ReplicationStrategy: "NetworkTopologyStrategy",
+		Datacenters:         ParseDatacenters("us-east=3, eu-west=2,bad"),
+	}
+	replication, err = config.Replication()
+	assert.Nil(t, err)
+	assert.Equal(t, replication, "{'class': 'NetworkTopologyStrategy', 'eu-west': 2, 'us-east': 3}")
+
+	config.Datacenters = map[string]int{}
+	_, err = config.Replication()
+	assert.NotNil(t, err, "should need a datacenter")
+
+	config.ReplicationStrategy = "LocalStrategy"
+	_, err = config.Replication()
+	assert.NotNil(t, err)
+}
+
+func TestClusterVerifiesCertificates(t *testing.T) {
+	config := &CassandraConfig{Hosts: []string{"cassandra"}, TLS: true}
+	assert.True(t, config.Cluster().SslOpts.EnableHostVerification, "should verify by default")
+
+	config.InsecureSkipVerify = true
+	assert.False(t, config.Cluster().SslOpts.EnableHostVerification)
+}
@@ -0,0 +1,287 @@
+package shared
+
+import (
+	"sort"
+	"sync"
+
+	st "shared/types"
+)
+
+// MemoryStore implements every store in memory, for tests. TTLs are
+// ignored.
+type MemoryStore struct {
+	lock       sync.Mutex
+	spans      map[string]map[string]st.SpanRow
+	selections map[string]map[string]st.InterestingTrace
+	archived   map[string]map[string]st.InterestingTrace
+	statuses   map[string]map[string]st.ExportStatus
+	// keyed by trace and span id (and tag), as the lookup tables would be
+	summaries map[string]st.SpanSummary
+	tags      map[string]st.TaggedSpanSummary
+	errs      []st.Error
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		spans:      make(map[string]map[string]st.SpanRow),
+		selections: make(map[string]map[string]st.InterestingTrace),
+		archived:   make(map[string]map[string]st.InterestingTrace),
+		statuses:   make(map[string]map[string]st.ExportStatus),
+		summaries:  make(map[string]st.SpanSummary),
+		tags:       make(map[string]st.TaggedSpanSummary),
+		errs:       make([]st.Error, 0),
+	}
+}
+
+func (m *MemoryStore) Close() {}
+
+func (m *MemoryStore) WriteSpans(rows []st.SpanRow, ttl int) []error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, row := range rows {
+		trace, ok := m.spans[row.TraceId]
+		if !ok {
+			trace = make(map[string]st.SpanRow)
+			m.spans[row.TraceId] = trace
+		}
+		trace[row.SpanId] = row
+	}
+	return nil
+}
+
+// TraceSpans gives spans back ordered by span id, as Cassandra would.
+func (m *MemoryStore) TraceSpans(traceId string) ([]st.SpanRow, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	rows := make([]st.SpanRow, 0, len(m.spans[traceId]))
+	for _, row := range m.spans[traceId] {
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].SpanId < rows[j].SpanId
+	})
+	return rows, nil
+}
+
+func (m *MemoryStore) CountSpans(traceId string) (int, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.spans[traceId]), nil
+}
+
+func (m *MemoryStore) IndexSpans(spans []st.SpanSummary, tags []st.TaggedSpanSummary, ttl int) []error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, span := range spans {
+		m.summaries[span.TraceId+"/"+span.SpanId] = span
+	}
+	for _, tag := range tags {
+		m.tags[tag.TraceId+"/"+tag.SpanId+"/"+tag.Tag] = tag
+	}
+	return nil
+}
+
+func (m *MemoryStore) FindSpans(lookup Lookup, hour int64, from float64, to float64, limit int) ([]st.SpanSummary, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	spans := make([]st.SpanSummary, 0)
+	found := func(span st.SpanSummary, tag string, value string) {
+		if span.Hour == hour && span.StartTime >= from && span.StartTime <= to && lookup.matches(span, tag, value) {
+			spans = append(spans, span)
+		}
+	}
+	if lookup.Tag != "" {
+		for _, tagged := range m.tags {
+			found(tagged.SpanSummary, tagged.Tag, tagged.Value)
+		}
+	} else {
+		for _, span := range m.summaries {
+			found(span, "", "")
+		}
+	}
+	sort.Slice(spans, func(i, j int) bool {
+		if spans[i].StartTime != spans[j].StartTime {
+			return spans[i].StartTime > spans[j].StartTime
+		}
+		if spans[i].TraceId != spans[j].TraceId {
+			return spans[i].TraceId < spans[j].TraceId
+		}
+		return spans[i].SpanId < spans[j].SpanId
+	})
+	if len(spans) > limit {
+		spans = spans[:limit]
+	}
+	return spans, nil
+}
+
+func (m *MemoryStore) Entities() ([]string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	seen := make(map[string]bool)
+	entities := make([]string, 0)
+	for _, span := range m.summaries {
+		if !seen[span.EntityName] {
+			seen[span.EntityName] = true
+			entities = append(entities, span.EntityName)
+		}
+	}
+	sort.Strings(entities)
+	return entities, nil
+}
+
+func (m *MemoryStore) SpanNames(entityName string) ([]string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	seen := make(map[string]bool)
+	names := make([]string, 0)
+	for _, span := range m.summaries {
+		if span.EntityName == entityName && !seen[span.Name] {
+			seen[span.Name] = true
+			names = append(names, span.Name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (m *MemoryStore) SaveSelections(traces []*st.InterestingTrace, ttl int) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, trace := range traces {
+		reasons, ok := m.selections[trace.TraceId]
+		if !ok {
+			reasons = make(map[string]st.InterestingTrace)
+			m.selections[trace.TraceId] = reasons
+		}
+		reasons[trace.Reason] = *trace
+	}
+	return nil
+}
+
+func (m *MemoryStore) HasSelection(traceId string, reason string) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	_, ok := m.selections[traceId][reason]
+	return ok, nil
+}
+
+func (m *MemoryStore) Selections() ([]st.InterestingTrace, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	traces := make([]st.InterestingTrace, 0)
+	for _, reasons := range m.selections {
+		for _, trace := range reasons {
+			traces = append(traces, trace)
+		}
+	}
+	return traces, nil
+}
+
+func (m *MemoryStore) TraceSelections(traceId string) ([]st.InterestingTrace, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	live := make([]st.InterestingTrace, 0)
+	for _, trace := range m.selections[traceId] {
+		live = append(live, trace)
+	}
+	archived := make([]st.InterestingTrace, 0)
+	for _, trace := range m.archived[traceId] {
+		archived = append(archived, trace)
+	}
+	return mergeSelections(live, archived), nil
+}
+
+func (m *MemoryStore) DeleteSelection(traceId string, reason string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.selections[traceId], reason)
+	if len(m.selections[traceId]) == 0 {
+		delete(m.selections, traceId)
+	}
+	return nil
+}
+
+func (m *MemoryStore) ArchiveTrace(traceId string, ttl int) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	reasons, ok := m.selections[traceId]
+	if !ok {
+		return nil
+	}
+	archived, ok := m.archived[traceId]
+	if !ok {
+		archived = make(map[string]st.InterestingTrace)
+		m.archived[traceId] = archived
+	}
+	for reason, trace := range reasons {
+		archived[reason] = trace
+	}
+	delete(m.selections, traceId)
+	return nil
+}
+
+func (m *MemoryStore) ExportStatus(traceId string, destination string) (*st.ExportStatus, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	status, ok := m.statuses[traceId][destination]
+	if !ok {
+		return st.NewExportStatus(traceId, destination), nil
+	}
+	status.ExportedSpanIds = append([]string{}, status.ExportedSpanIds...)
+	return &status, nil
+}
+
+func (m *MemoryStore) ExportStatuses(traceId string) ([]st.ExportStatus, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	statuses := make([]st.ExportStatus, 0)
+	for _, status := range m.statuses[traceId] {
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+func (m *MemoryStore) SaveExportStatus(status *st.ExportStatus, ttl int) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	destinations, ok := m.statuses[status.TraceId]
+	if !ok {
+		destinations = make(map[string]st.ExportStatus)
+		m.statuses[status.TraceId] = destinations
+	}
+	saved := *status
+	saved.ExportedSpanIds = append([]string{}, status.ExportedSpanIds...)
+	destinations[status.Destination] = saved
+	return nil
+}
+
+func (m *MemoryStore) SaveError(e *st.Error) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.errs = append(m.errs, *e)
+	return nil
+}
+
+func (m *MemoryStore) FindErrors(filter ErrorFilter) ([]st.Error, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	errs := make([]st.Error, 0)
+	for _, e := range m.errs {
+		if filter.matches(e) {
+			errs = append(errs, e)
+		}
+	}
+	return newestErrors(errs, filter.Limit), nil
+}
+
+func (m *MemoryStore) ErrorCounts(filter ErrorFilter) (map[string]int, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	counts := make(map[string]int)
+	for _, e := range m.errs {
+		if filter.matches(e) {
+			counts[e.Component]++
+		}
+	}
+	return counts, nil
+}
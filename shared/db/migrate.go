@@ -0,0 +1,145 @@
+package shared
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// Migration is one versioned change to the schema. Migrations are run once,
+// in version order, and recorded in the keyspace's schema_migrations table.
+type Migration struct {
+	Version     int
+	Description string
+	Statements  []string
+	// for changes CQL can't make alone, run after the statements. It should
+	// be safe to run again if it stops part way.
+	Run func(session *gocql.Session) error
+}
+
+var MIGRATIONS_TABLE string = "schema_migrations"
+
+// MIGRATION_STEPS_TABLE records each statement of a migration as it is run,
+// so a migration that stops part way picks up where it left off.
+var MIGRATION_STEPS_TABLE string = "schema_migration_steps"
+
+func migrationsTable(keyspace string) string {
+	return keyspace + "." + MIGRATIONS_TABLE
+}
+
+func migrationStepsTable(keyspace string) string {
+	return keyspace + "." + MIGRATION_STEPS_TABLE
+}
+
+// steps lists what running a migration involves, in order.
+func (m Migration) steps() []func(session *gocql.Session) error {
+	steps := make([]func(session *gocql.Session) error, 0, len(m.Statements)+1)
+	for _, statement := range m.Statements {
+		statement := statement
+		steps = append(steps, func(session *gocql.Session) error {
+			return session.Query(statement).Exec()
+		})
+	}
+	if m.Run != nil {
+		steps = append(steps, m.Run)
+	}
+	return steps
+}
+
+func appliedSteps(session *gocql.Session, keyspace string, version int) (map[int]bool, error) {
+	applied := make(map[int]bool)
+	iter := session.Query("SELECT step FROM "+migrationStepsTable(keyspace)+" WHERE version = ?", version).Iter()
+	var step int
+	for iter.Scan(&step) {
+		applied[step] = true
+	}
+	return applied, iter.Close()
+}
+
+// pendingMigrations sorts out the migrations that haven't been applied yet,
+// in the order they should be run.
+func pendingMigrations(migrations []Migration, applied map[int]bool) []Migration {
+	pending := make([]Migration, 0)
+	for _, m := range migrations {
+		if !applied[m.Version] {
+			pending = append(pending, m)
+		}
+	}
+	sort.SliceStable(pending, func(i, j int) bool {
+		return pending[i].Version < pending[j].Version
+	})
+	return pending
+}
+
+// PendingMigrations lists the migrations not yet applied to keyspace.
+func PendingMigrations(session *gocql.Session, keyspace string, migrations []Migration) ([]Migration, error) {
+	applied := make(map[int]bool)
+	iter := session.Query("SELECT version FROM " + migrationsTable(keyspace)).Iter()
+	var version int
+	for iter.Scan(&version) {
+		applied[version] = true
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return pendingMigrations(migrations, applied), nil
+}
+
+// Migrate creates keyspace with the given replication if needed, and runs any
+// pending migrations on it. It stops at the first migration that fails so it
+// can be fixed and rerun.
+func Migrate(session *gocql.Session, keyspace string, replication string, migrations []Migration) error {
+	if err := createKeyspace(session, keyspace, replication); err != nil {
+		return err
+	}
+	for _, statement := range []string{
+		"CREATE TABLE IF NOT EXISTS " + migrationsTable(keyspace) + " (version int, description text, applied_at timestamp, PRIMARY KEY(version));",
+		"CREATE TABLE IF NOT EXISTS " + migrationStepsTable(keyspace) + " (version int, step int, applied_at timestamp, PRIMARY KEY(version, step));",
+	} {
+		if err := session.Query(statement).Exec(); err != nil {
+			return err
+		}
+	}
+
+	pending, err := PendingMigrations(session, keyspace, migrations)
+	if err != nil {
+		return err
+	}
+	for _, m := range pending {
+		log.Printf("running migration %d: %s", m.Version, m.Description)
+		applied, err := appliedSteps(session, keyspace, m.Version)
+		if err != nil {
+			return err
+		}
+		for i, step := range m.steps() {
+			if applied[i] {
+				continue
+			}
+			if err := step(session); err != nil {
+				return fmt.Errorf("migration %d (%s) failed at step %d: %v", m.Version, m.Description, i+1, err)
+			}
+			err := session.Query(
+				"INSERT INTO "+migrationStepsTable(keyspace)+" (version, step, applied_at) VALUES (?, ?, ?);",
+				m.Version,
+				i,
+				time.Now(),
+			).Exec()
+			if err != nil {
+				return err
+			}
+		}
+		err = session.Query(
+			"INSERT INTO "+migrationsTable(keyspace)+" (version, description, applied_at) VALUES (?, ?, ?);",
+			m.Version,
+			m.Description,
+			time.Now(),
+		).Exec()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package shared
+
+import (
+	"strings"
+
+	st "shared/types"
+)
+
+var KEYSPACE string = "span_collector"
+
+// Table ties a table to the struct its rows are written from.
+type Table struct {
+	Name        string
+	Source      interface{}
+	PrimaryKeys string
+	// e.g. the clustering order
+	Options string
+}
+
+func (t Table) Schema() string {
+	schema := CreateTable(t.Source, t.Name, t.PrimaryKeys)
+	if t.Options == "" {
+		return schema
+	}
+	return strings.TrimSuffix(schema, ";") + " WITH " + t.Options + ";"
+}
+
+// the lookup tables list the most recent spans first
+var recentFirst = "CLUSTERING ORDER BY (start_time DESC, trace_id ASC, span_id ASC)"
+
+var TABLES = []Table{
+	{SPANS_TABLE, st.SpanRow{}, "trace_id, span_id", ""},
+	{SELECTIONS_TABLE, st.InterestingTrace{}, "trace_id, reason", ""},
+	{SELECTION_ARCHIVE_TABLE, st.InterestingTrace{}, "trace_id, reason", ""},
+	{EXPORT_STATUS_TABLE, st.ExportStatus{}, "trace_id, destination", ""},
+	{ERRORS_TABLE, st.Error{}, "component, timestamp", ""},
+	{SPANS_BY_ENTITY_TABLE, st.SpanSummary{}, "(entity_name, hour), start_time, trace_id, span_id", recentFirst},
+	{SPANS_BY_NAME_TABLE, st.SpanSummary{}, "(name, hour), start_time, trace_id, span_id", recentFirst},
+	{SPANS_BY_TAG_TABLE, st.TaggedSpanSummary{}, "(tag, value, hour), start_time, trace_id, span_id", recentFirst},
+	{SPAN_NAMES_TABLE, st.SpanName{}, "entity_name, name", ""},
+}
+
+// createTables is the first migration, also used to upgrade tables the
+// services created for themselves before there were migrations.
+var createTables = []string{
+	"CREATE TABLE IF NOT EXISTS span_collector.spans (trace_id text, span_id text, parent_id text, name text, start_time double, finish_time double, string_tags map<text, text>, boolean_tags map<text, boolean>, number_tags map<text, double>, json_tags map<text, text>, entity_name text, license_key text, entity_id text, PRIMARY KEY(trace_id, span_id));",
+	"CREATE TABLE IF NOT EXISTS span_collector.interesting_traces (trace_id text, reason text, span_id text, entity_name text, score double, selected_at timestamp, PRIMARY KEY(trace_id, reason));",
+	"CREATE TABLE IF NOT EXISTS span_collector.export_status (trace_id text, destination text, status text, attempts int, last_error text, exported_span_ids set<text>, created_at timestamp, updated_at timestamp, PRIMARY KEY(trace_id, destination));",
+	"CREATE TABLE IF NOT EXISTS span_collector.system_errors (message text, stack text, timestamp timestamp, component text, event text, PRIMARY KEY(component, timestamp));",
+}
+
+// MIGRATIONS is the schema history of the span_collector keyspace. Only ever
+// add to the end of this, a migration that has already run won't be run
+// again. When a struct backing a table changes, `migrator -schema` prints what
+// the tables should now look like.
+var MIGRATIONS = []Migration{
+	{
+		Version:     1,
+		Description: "create tables",
+		Statements:  createTables,
+	}, {
+		Version:     2,
+		Description: "add span lookup tables",
+		Statements: []string{
+			"CREATE TABLE IF NOT EXISTS span_collector.spans_by_entity (trace_id text, span_id text, entity_name text, name text, hour bigint, start_time double, duration double, PRIMARY KEY((entity_name, hour), start_time, trace_id, span_id)) WITH CLUSTERING ORDER BY (start_time DESC, trace_id ASC, span_id ASC);",
+			"CREATE TABLE IF NOT EXISTS span_collector.spans_by_name (trace_id text, span_id text, entity_name text, name text, hour bigint, start_time double, duration double, PRIMARY KEY((name, hour), start_time, trace_id, span_id)) WITH CLUSTERING ORDER BY (start_time DESC, trace_id ASC, span_id ASC);",
+			"CREATE TABLE IF NOT EXISTS span_collector.spans_by_tag (trace_id text, span_id text, entity_name text, name text, hour bigint, start_time double, duration double, tag text, value text, PRIMARY KEY((tag, value, hour), start_time, trace_id, span_id)) WITH CLUSTERING ORDER BY (start_time DESC, trace_id ASC, span_id ASC);",
+			"CREATE TABLE IF NOT EXISTS span_collector.span_names (entity_name text, name text, PRIMARY KEY(entity_name, name));",
+		},
+	}, {
+		Version:     3,
+		Description: "record the message behind each system error",
+		Statements: []string{
+			"ALTER TABLE span_collector.system_errors ADD message_id text;",
+		},
+	}, {
+		Version:     4,
+		Description: "upgrade tables created before migrations",
+		Run:         upgradeLegacyTables,
+	}, {
+		Version:     5,
+		Description: "archive the selections of exported traces",
+		Statements: []string{
+			"CREATE TABLE IF NOT EXISTS span_collector.selection_archive (trace_id text, reason text, span_id text, entity_name text, score double, selected_at timestamp, PRIMARY KEY(trace_id, reason));",
+		},
+	},
+}
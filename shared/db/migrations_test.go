@@ -0,0 +1,143 @@
+package shared
+
+import (
+	"reflect"
+	"regexp"
+	"sort"
+	"testing"
+
+	st "shared/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var addColumnPattern = regexp.MustCompile(`^ALTER TABLE (\S+) ADD (\w+) (.+);$`)
+
+// replayMigrations works out the columns each table ends up with.
+func replayMigrations(migrations []Migration) map[string][]string {
+	tables := make(map[string][]string)
+	for _, m := range pendingMigrations(migrations, map[int]bool{}) {
+		for _, statement := range m.Statements {
+			if match := createTablePattern.FindStringSubmatch(statement); match != nil {
+				tables[match[1]] = splitColumns(match[2])
+			} else if match := addColumnPattern.FindStringSubmatch(statement); match != nil {
+				tables[match[1]] = append(tables[match[1]], match[2]+" "+match[3])
+			}
+		}
+	}
+	for table := range tables {
+		sort.Strings(tables[table])
+	}
+	return tables
+}
+
+func TestMigrationsMatchStructs(t *testing.T) {
+	tables := replayMigrations(MIGRATIONS)
+	for _, table := range TABLES {
+		match := createTablePattern.FindStringSubmatch(table.Schema())
+		expected := splitColumns(match[2])
+		sort.Strings(expected)
+		assert.Equal(t, tables[table.Name], expected, "migrations for "+table.Name+" should match "+reflect.TypeOf(table.Source).Name())
+	}
+}
+
+func TestMigrationVersions(t *testing.T) {
+	for i, m := range MIGRATIONS {
+		assert.Equal(t, m.Version, i+1, "migrations should be numbered in order")
+	}
+}
+
+func TestPendingMigrations(t *testing.T) {
+	migrations := []Migration{{Version: 3}, {Version: 1}, {Version: 2}}
+	pending := pendingMigrations(migrations, map[int]bool{1: true})
+	assert.Equal(t, pending, []Migration{{Version: 2}, {Version: 3}}, "should skip applied migrations and run the rest in order")
+}
+
+func TestCreateTable(t *testing.T) {
+	assert.Equal(t,
+		CreateTable(st.InterestingTrace{}, "ks.traces", "trace_id, reason"),
+		"CREATE TABLE IF NOT EXISTS ks.traces (trace_id text, reason text, span_id text, entity_name text, score double, selected_at timestamp, PRIMARY KEY(trace_id, reason));",
+		"columns should be in field order",
+	)
+}
+
+func TestParsePrimaryKey(t *testing.T) {
+	partition, clustering := parsePrimaryKey("trace_id, span_id")
+	assert.Equal(t, partition, []string{"trace_id"})
+	assert.Equal(t, clustering, []string{"span_id"})
+
+	partition, clustering = parsePrimaryKey("(tag, value, hour), start_time, trace_id")
+	assert.Equal(t, partition, []string{"tag", "value", "hour"})
+	assert.Equal(t, clustering, []string{"start_time", "trace_id"})
+
+	partition, clustering = parsePrimaryKey("trace_id")
+	assert.Equal(t, partition, []string{"trace_id"})
+	assert.Empty(t, clustering)
+}
+
+func TestParseCreateTable(t *testing.T) {
+	for _, table := range TABLES {
+		name, layout, err := parseCreateTable(table.Schema())
+		assert.Nil(t, err)
+		assert.Equal(t, name, table.Name)
+		assert.NotEmpty(t, layout.PartitionKey)
+	}
+	_, layout, _ := parseCreateTable(createTables[0])
+	assert.Equal(t, layout.Columns["boolean_tags"], "map<text,boolean>", "should normalize types")
+}
+
+func TestPlanUpgrade(t *testing.T) {
+	_, spans, _ := parseCreateTable(createTables[0])
+	// as span-recorder used to create it
+	legacySpans := &tableLayout{
+		PartitionKey: []string{"trace_id"},
+		Clustering:   []string{"sent", "span_id"},
+		Columns: map[string]string{
+			"trace_id": "text", "span_id": "text", "sent": "boolean", "name": "text",
+			"boolean_tags": "map<text,boolean>", "custom": "text",
+		},
+	}
+	plan, err := planUpgrade(legacySpans, spans, nil)
+	assert.Nil(t, err)
+	assert.True(t, plan.Rebuild)
+	assert.Equal(t, plan.Copied, []string{"boolean_tags", "name", "span_id", "trace_id"})
+	assert.Equal(t, plan.Carried, []string{"custom"}, "should keep columns it doesn't know about, but not old keys")
+
+	_, selections, _ := parseCreateTable(createTables[1])
+	legacySelections := &tableLayout{
+		PartitionKey: []string{"trace_id"},
+		Clustering:   []string{},
+		Columns:      map[string]string{"trace_id": "text"},
+	}
+	_, err = planUpgrade(legacySelections, selections, nil)
+	assert.NotNil(t, err, "should fail without a value for the new key")
+	plan, err = planUpgrade(legacySelections, selections, legacyDefaults[SELECTIONS_TABLE])
+	assert.Nil(t, err)
+	assert.True(t, plan.Rebuild)
+	assert.Equal(t, plan.Copied, []string{"trace_id"})
+
+	// keyed right, but from before json tags
+	sameKey := &tableLayout{
+		PartitionKey: spans.PartitionKey,
+		Clustering:   spans.Clustering,
+		Columns:      make(map[string]string),
+	}
+	for column, columnType := range spans.Columns {
+		if column != "json_tags" {
+			sameKey.Columns[column] = columnType
+		}
+	}
+	plan, err = planUpgrade(sameKey, spans, nil)
+	assert.Nil(t, err)
+	assert.False(t, plan.Rebuild)
+	assert.Equal(t, plan.Missing, []string{"json_tags"})
+
+	sameKey.Columns["name"] = "int"
+	_, err = planUpgrade(sameKey, spans, nil)
+	assert.NotNil(t, err, "should fail on a column it can't change the type of")
+}
+
+func TestMigrationSteps(t *testing.T) {
+	assert.Equal(t, len(MIGRATIONS[0].steps()), len(createTables))
+	assert.Equal(t, len(MIGRATIONS[3].steps()), 1)
+}
@@ -0,0 +1,114 @@
+package shared
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/gocql/gocql"
+)
+
+type column struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+// parseTag splits a cassandra struct tag into the column name and whether
+// zero values should be left unset.
+func parseTag(tag string) (string, bool) {
+	parts := strings.Split(tag, ",")
+	omitEmpty := false
+	for _, option := range parts[1:] {
+		if option == "omitempty" {
+			omitEmpty = true
+		}
+	}
+	return parts[0], omitEmpty
+}
+
+// columnsOf lists the columns a struct type maps to using its cassandra tags.
+// Embedded structs without a tag of their own have their columns pulled up.
+func columnsOf(t reflect.Type, parent []int) []column {
+	columns := make([]column, 0)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		index := append(append([]int{}, parent...), i)
+		tag, ok := field.Tag.Lookup("cassandra")
+		if !ok {
+			if field.Anonymous && field.Type.Kind() == reflect.Struct {
+				columns = append(columns, columnsOf(field.Type, index)...)
+			}
+			continue
+		}
+		name, omitEmpty := parseTag(tag)
+		columns = append(columns, column{name: name, index: index, omitEmpty: omitEmpty})
+	}
+	return columns
+}
+
+// Insert is an INSERT for one struct type into one table. Every tagged field
+// is always bound, so the CQL never changes and gocql only has to prepare it
+// once per host. Fields tagged omitempty are left unset when they are zero
+// rather than being written as nulls.
+type Insert struct {
+	Statement string
+	Columns   []string
+	columns   []column
+}
+
+type insertKey struct {
+	t       reflect.Type
+	table   string
+	withTTL bool
+}
+
+var insertCache sync.Map
+
+// InsertFor gives back the (cached) insert for source's type into table.
+// withTTL adds a USING TTL clause, the TTL being bound after the fields.
+func InsertFor(source interface{}, table string, withTTL bool) *Insert {
+	t := reflect.TypeOf(source)
+	key := insertKey{t: t, table: table, withTTL: withTTL}
+	if insert, ok := insertCache.Load(key); ok {
+		return insert.(*Insert)
+	}
+
+	columns := columnsOf(t, nil)
+	names := make([]string, len(columns))
+	for i, c := range columns {
+		names[i] = c.name
+	}
+	placeholderValues := []string{"?"}
+	statement := "INSERT INTO " + table + " (" + strings.Join(names, ", ") + ") VALUES (" + MakePlaceholderString(&placeholderValues, len(names)) + ")"
+	if withTTL {
+		statement += " USING TTL ?"
+	}
+	insert, _ := insertCache.LoadOrStore(key, &Insert{
+		Statement: statement + ";",
+		Columns:   names,
+		columns:   columns,
+	})
+	return insert.(*Insert)
+}
+
+// Values gives back what to bind for source, followed by extra (e.g. the
+// TTL).
+func (i *Insert) Values(source interface{}, extra ...interface{}) []interface{} {
+	srcVal := reflect.ValueOf(source)
+	values := make([]interface{}, 0, len(i.columns)+len(extra))
+	for _, c := range i.columns {
+		field := srcVal.FieldByIndex(c.index)
+		if c.omitEmpty && field.IsZero() {
+			values = append(values, gocql.UnsetValue)
+			continue
+		}
+		values = append(values, field.Interface())
+	}
+	return append(values, extra...)
+}
+
+// Query binds source to the insert.
+func (i *Insert) Query(session *gocql.Session, source interface{}, extra ...interface{}) *gocql.Query {
+	return session.Query(i.Statement, i.Values(source, extra...)...)
+}
@@ -0,0 +1,35 @@
+package shared
+
+import (
+	"testing"
+
+	"github.com/gocql/gocql"
+	"github.com/stretchr/testify/assert"
+)
+
+type TestRow struct {
+	TestStruct
+	Qux string `cassandra:"qux,omitempty"`
+}
+
+func TestInsertFor(t *testing.T) {
+	insert := InsertFor(TestRow{}, "ks.table", true)
+	assert.Equal(t, insert.Statement, "INSERT INTO ks.table (foo, bar, qux) VALUES (?, ?, ?) USING TTL ?;")
+	assert.Equal(t, insert.Columns, []string{"foo", "bar", "qux"}, "should pull up embedded columns")
+	assert.Same(t, insert, InsertFor(TestRow{Qux: "a"}, "ks.table", true), "should be cached per type and table")
+	assert.NotSame(t, insert, InsertFor(TestRow{}, "ks.other", true))
+
+	insert = InsertFor(TestStruct{}, "ks.table", false)
+	assert.Equal(t, insert.Statement, "INSERT INTO ks.table (foo, bar) VALUES (?, ?);")
+}
+
+func TestInsertValues(t *testing.T) {
+	insert := InsertFor(TestRow{}, "ks.table", true)
+	assert.Equal(t, insert.Values(TestRow{TestStruct: TestStruct{Foo: "test", Bar: 1}}, 60), []interface{}{
+		"test",
+		uint32(1),
+		gocql.UnsetValue,
+		60,
+	}, "should leave empty omitempty columns unset")
+	assert.Equal(t, insert.Values(TestRow{Qux: "set"})[2], "set")
+}
@@ -0,0 +1,78 @@
+package shared
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	sc "shared/config"
+)
+
+// RetentionPolicy decides how long rows live for, with optional overrides
+// for specific entities. A TTL of zero keeps rows forever.
+type RetentionPolicy struct {
+	Default  time.Duration
+	Entities map[string]time.Duration
+}
+
+// NewRetentionPolicyFromEnv reads the default TTL from RETENTION_TTL, and
+// per entity overrides from RETENTION_OVERRIDES, which is formatted like
+// "checkout=720h,search=24h".
+func NewRetentionPolicyFromEnv() *RetentionPolicy {
+	return &RetentionPolicy{
+		Default:  sc.Duration("RETENTION_TTL", 7*24*time.Hour),
+		Entities: ParseRetentionOverrides(sc.String("RETENTION_OVERRIDES", "")),
+	}
+}
+
+func ParseRetentionOverrides(overrides string) map[string]time.Duration {
+	entities := make(map[string]time.Duration)
+	for _, override := range strings.Split(overrides, ",") {
+		override = strings.TrimSpace(override)
+		if override == "" {
+			continue
+		}
+		parts := strings.SplitN(override, "=", 2)
+		if len(parts) != 2 {
+			log.Printf("ignoring malformed retention override %q", override)
+			continue
+		}
+		ttl, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil {
+			log.Printf("ignoring malformed retention override %q: %s", override, err)
+			continue
+		}
+		entities[strings.TrimSpace(parts[0])] = ttl
+	}
+	return entities
+}
+
+// TTL gives the number of seconds rows for the given entity should be kept,
+// ready to bind to a USING TTL clause.
+func (r *RetentionPolicy) TTL(entityName string) int {
+	ttl, ok := r.Entities[entityName]
+	if !ok {
+		ttl = r.Default
+	}
+	return int(ttl / time.Second)
+}
+
+// MaxTTL gives the longest TTL of any of the entities, for rows that belong to
+// all of them. With no entities it's the default.
+func (r *RetentionPolicy) MaxTTL(entityNames ...string) int {
+	if len(entityNames) == 0 {
+		return int(r.Default / time.Second)
+	}
+	max := 0
+	for i, entityName := range entityNames {
+		ttl := r.TTL(entityName)
+		if ttl == 0 {
+			// kept forever
+			return 0
+		}
+		if i == 0 || ttl > max {
+			max = ttl
+		}
+	}
+	return max
+}
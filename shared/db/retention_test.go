@@ -0,0 +1,44 @@
+package shared
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRetentionOverrides(t *testing.T) {
+	overrides := ParseRetentionOverrides(" checkout=720h, search=24h,broken,bad=forever,")
+	assert.Equal(t, overrides, map[string]time.Duration{
+		"checkout": 720 * time.Hour,
+		"search":   24 * time.Hour,
+	}, "should only pick up well formed overrides")
+}
+
+func TestRetentionPolicyTTL(t *testing.T) {
+	policy := RetentionPolicy{
+		Default: time.Hour,
+		Entities: map[string]time.Duration{
+			"checkout": 2 * time.Hour,
+			"forever":  0,
+		},
+	}
+	assert.Equal(t, policy.TTL("search"), 3600, "should fall back to the default")
+	assert.Equal(t, policy.TTL("checkout"), 7200, "should use the entity override")
+	assert.Equal(t, policy.TTL("forever"), 0, "should allow turning the ttl off")
+}
+
+func TestRetentionPolicyMaxTTL(t *testing.T) {
+	policy := RetentionPolicy{
+		Default: time.Hour,
+		Entities: map[string]time.Duration{
+			"checkout": 2 * time.Hour,
+			"search":   time.Minute,
+			"forever":  0,
+		},
+	}
+	assert.Equal(t, policy.MaxTTL("search", "checkout"), 7200, "should keep rows as long as any entity wants")
+	assert.Equal(t, policy.MaxTTL("search"), 60)
+	assert.Equal(t, policy.MaxTTL("checkout", "forever"), 0, "should keep rows forever if any entity does")
+	assert.Equal(t, policy.MaxTTL(), 3600, "should fall back to the default")
+}
@@ -0,0 +1,57 @@
+package shared
+
+import (
+	"reflect"
+	"strings"
+	"time"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// CassandraType picks the CQL type for a Go type. Slices are stored as sets
+// since nothing we keep cares about order or duplicates.
+func CassandraType(t reflect.Type) string {
+	if t == timeType {
+		return "timestamp"
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "text"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int8, reflect.Uint8:
+		return "tinyint"
+	case reflect.Int16, reflect.Uint16:
+		return "smallint"
+	case reflect.Int, reflect.Int32, reflect.Uint32:
+		return "int"
+	case reflect.Int64, reflect.Uint64:
+		return "bigint"
+	case reflect.Float32:
+		return "float"
+	case reflect.Float64:
+		return "double"
+	case reflect.Map:
+		return "map<" + CassandraType(t.Key()) + ", " + CassandraType(t.Elem()) + ">"
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "blob"
+		}
+		return "set<" + CassandraType(t.Elem()) + ">"
+	case reflect.Ptr:
+		return CassandraType(t.Elem())
+	}
+	return "blob"
+}
+
+// CreateTable generates the CREATE TABLE statement for a struct type using
+// its cassandra tags, with columns in the order the fields are declared.
+func CreateTable(source interface{}, table string, primaryKeys string) string {
+	t := reflect.TypeOf(source)
+	columns := columnsOf(t, nil)
+	fieldSchema := make([]string, len(columns))
+	for i, c := range columns {
+		fieldSchema[i] = c.name + " " + CassandraType(t.FieldByIndex(c.index).Type)
+	}
+	return "CREATE TABLE IF NOT EXISTS " + table + " (" + strings.Join(fieldSchema, ", ") + ", PRIMARY KEY(" + primaryKeys + "));"
+}
@@ -0,0 +1,524 @@
+//go:build sqlite
+// +build sqlite
+
+package shared
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	sc "shared/config"
+	st "shared/types"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SQLiteStore implements every store in a single SQLite file, so small
+// installs can do without Cassandra. Several processes can share the file.
+// Rows past their TTL are hidden from reads and cleaned out when the store is
+// opened.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+func init() {
+	RegisterBackend("sqlite", func() (Store, error) {
+		return NewSQLiteStore(sc.String("SQLITE_PATH", "/data/span_collector.db"))
+	})
+}
+
+func sqliteTable(table string) string {
+	return strings.TrimPrefix(table, KEYSPACE+".")
+}
+
+func sqliteType(t reflect.Type) string {
+	if t == timeType {
+		// unix nanoseconds
+		return "INTEGER"
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "TEXT"
+	case reflect.Float32, reflect.Float64:
+		return "REAL"
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "INTEGER"
+	}
+	// maps and sets are stored JSON encoded
+	return "TEXT"
+}
+
+// sqliteSchema creates a table like the Cassandra one, plus an expiry.
+func sqliteSchema(table Table) string {
+	t := reflect.TypeOf(table.Source)
+	columns := columnsOf(t, nil)
+	fieldSchema := make([]string, len(columns))
+	for i, c := range columns {
+		fieldSchema[i] = c.name + " " + sqliteType(t.FieldByIndex(c.index).Type)
+	}
+	// there are no partition keys to pick out
+	primaryKeys := strings.NewReplacer("(", "", ")", "").Replace(table.PrimaryKeys)
+	return "CREATE TABLE IF NOT EXISTS " + sqliteTable(table.Name) + " (" + strings.Join(fieldSchema, ", ") + ", expires_at INTEGER NOT NULL DEFAULT 0, PRIMARY KEY(" + primaryKeys + "));"
+}
+
+// addColumns brings a table created from an older version of its struct up
+// to date, as the Cassandra migrations would.
+func addColumns(db *sql.DB, table Table) error {
+	rows, err := db.Query("PRAGMA table_info(" + sqliteTable(table.Name) + ")")
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, columnType string
+		var defaultValue interface{}
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &pk); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	t := reflect.TypeOf(table.Source)
+	for _, c := range columnsOf(t, nil) {
+		if existing[c.name] {
+			continue
+		}
+		_, err := db.Exec("ALTER TABLE " + sqliteTable(table.Name) + " ADD COLUMN " + c.name + " " + sqliteType(t.FieldByIndex(c.index).Type))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, err
+	}
+	s := &SQLiteStore{db: db}
+	now := time.Now().Unix()
+	for _, table := range TABLES {
+		if _, err := db.Exec(sqliteSchema(table)); err != nil {
+			db.Close()
+			return nil, err
+		}
+		if err := addColumns(db, table); err != nil {
+			db.Close()
+			return nil, err
+		}
+		_, err := db.Exec("DELETE FROM "+sqliteTable(table.Name)+" WHERE expires_at != 0 AND expires_at <= ?", now)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *SQLiteStore) Close() {
+	s.db.Close()
+}
+
+func expiresAt(ttl int) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return time.Now().Unix() + int64(ttl)
+}
+
+// live filters out expired rows
+func live() string {
+	return fmt.Sprintf("(expires_at = 0 OR expires_at > %d)", time.Now().Unix())
+}
+
+func sqliteValues(source interface{}) ([]interface{}, error) {
+	srcVal := reflect.ValueOf(source)
+	columns := columnsOf(srcVal.Type(), nil)
+	values := make([]interface{}, len(columns))
+	for i, c := range columns {
+		field := srcVal.FieldByIndex(c.index)
+		switch {
+		case field.Type() == timeType:
+			values[i] = field.Interface().(time.Time).UnixNano()
+		case field.Kind() == reflect.Map || field.Kind() == reflect.Slice:
+			encoded, err := json.Marshal(field.Interface())
+			if err != nil {
+				return nil, err
+			}
+			values[i] = string(encoded)
+		default:
+			values[i] = field.Interface()
+		}
+	}
+	return values, nil
+}
+
+// upsert writes source to table, replacing any row with the same key.
+func upsert(exec func(string, ...interface{}) (sql.Result, error), table string, source interface{}, ttl int) error {
+	values, err := sqliteValues(source)
+	if err != nil {
+		return err
+	}
+	names := selectColumns(source)
+	placeholderValues := []string{"?"}
+	_, err = exec(
+		"INSERT OR REPLACE INTO "+sqliteTable(table)+" ("+names+", expires_at) VALUES ("+MakePlaceholderString(&placeholderValues, len(values)+1)+")",
+		append(values, expiresAt(ttl))...,
+	)
+	return err
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanRow fills in dest (a pointer to a struct) from a row selected with
+// selectColumns.
+func scanRow(row scanner, dest interface{}) error {
+	destVal := reflect.ValueOf(dest).Elem()
+	columns := columnsOf(destVal.Type(), nil)
+	raw := make([]interface{}, len(columns))
+	targets := make([]interface{}, len(columns))
+	for i := range raw {
+		targets[i] = &raw[i]
+	}
+	if err := row.Scan(targets...); err != nil {
+		return err
+	}
+	for i, c := range columns {
+		field := destVal.FieldByIndex(c.index)
+		if raw[i] == nil {
+			continue
+		}
+		switch v := raw[i].(type) {
+		case []byte:
+			raw[i] = string(v)
+		}
+		switch {
+		case field.Type() == timeType:
+			field.Set(reflect.ValueOf(time.Unix(0, raw[i].(int64))))
+		case field.Kind() == reflect.Map || field.Kind() == reflect.Slice:
+			if err := json.Unmarshal([]byte(raw[i].(string)), field.Addr().Interface()); err != nil {
+				return err
+			}
+		case field.Kind() == reflect.Bool:
+			field.SetBool(raw[i].(int64) != 0)
+		default:
+			field.Set(reflect.ValueOf(raw[i]).Convert(field.Type()))
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteStore) WriteSpans(rows []st.SpanRow, ttl int) []error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return []error{err}
+	}
+	errs := make([]error, 0)
+	for _, row := range rows {
+		if err := upsert(tx.Exec, SPANS_TABLE, row, ttl); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+func (s *SQLiteStore) TraceSpans(traceId string) ([]st.SpanRow, error) {
+	rows, err := s.db.Query("SELECT "+selectColumns(st.SpanRow{})+" FROM "+sqliteTable(SPANS_TABLE)+" WHERE trace_id = ? AND "+live()+" ORDER BY span_id", traceId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	spans := make([]st.SpanRow, 0)
+	for rows.Next() {
+		var row st.SpanRow
+		if err := scanRow(rows, &row); err != nil {
+			return nil, err
+		}
+		spans = append(spans, row)
+	}
+	return spans, rows.Err()
+}
+
+func (s *SQLiteStore) CountSpans(traceId string) (int, error) {
+	var count int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM "+sqliteTable(SPANS_TABLE)+" WHERE trace_id = ? AND "+live(), traceId).Scan(&count)
+	return count, err
+}
+
+func (s *SQLiteStore) IndexSpans(spans []st.SpanSummary, tags []st.TaggedSpanSummary, ttl int) []error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return []error{err}
+	}
+	errs := make([]error, 0)
+	write := func(table string, source interface{}) {
+		if err := upsert(tx.Exec, table, source, ttl); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, span := range spans {
+		write(SPANS_BY_ENTITY_TABLE, span)
+		write(SPANS_BY_NAME_TABLE, span)
+		write(SPAN_NAMES_TABLE, st.SpanName{EntityName: span.EntityName, Name: span.Name})
+	}
+	for _, tag := range tags {
+		write(SPANS_BY_TAG_TABLE, tag)
+	}
+	if err := tx.Commit(); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+func (s *SQLiteStore) FindSpans(lookup Lookup, hour int64, from float64, to float64, limit int) ([]st.SpanSummary, error) {
+	where, values := lookup.partition(hour)
+	rows, err := s.db.Query(
+		"SELECT "+selectColumns(st.SpanSummary{})+" FROM "+sqliteTable(lookup.table())+" WHERE "+where+" AND start_time >= ? AND start_time <= ? AND "+live()+" ORDER BY start_time DESC, trace_id, span_id LIMIT ?",
+		append(values, from, to, limit)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	spans := make([]st.SpanSummary, 0)
+	for rows.Next() {
+		var span st.SpanSummary
+		if err := scanRow(rows, &span); err != nil {
+			return nil, err
+		}
+		spans = append(spans, span)
+	}
+	return spans, rows.Err()
+}
+
+func (s *SQLiteStore) strings(query string, values ...interface{}) ([]string, error) {
+	rows, err := s.db.Query(query, values...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	found := make([]string, 0)
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		found = append(found, value)
+	}
+	return found, rows.Err()
+}
+
+func (s *SQLiteStore) Entities() ([]string, error) {
+	return s.strings("SELECT DISTINCT entity_name FROM " + sqliteTable(SPAN_NAMES_TABLE) + " WHERE " + live() + " ORDER BY entity_name")
+}
+
+func (s *SQLiteStore) SpanNames(entityName string) ([]string, error) {
+	return s.strings("SELECT name FROM "+sqliteTable(SPAN_NAMES_TABLE)+" WHERE entity_name = ? AND "+live()+" ORDER BY name", entityName)
+}
+
+func (s *SQLiteStore) SaveSelections(traces []*st.InterestingTrace, ttl int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, trace := range traces {
+		if err := upsert(tx.Exec, SELECTIONS_TABLE, *trace, ttl); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) HasSelection(traceId string, reason string) (bool, error) {
+	var count int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM "+sqliteTable(SELECTIONS_TABLE)+" WHERE trace_id = ? AND reason = ? AND "+live(), traceId, reason).Scan(&count)
+	return count > 0, err
+}
+
+func (s *SQLiteStore) Selections() ([]st.InterestingTrace, error) {
+	rows, err := s.db.Query("SELECT " + selectColumns(st.InterestingTrace{}) + " FROM " + sqliteTable(SELECTIONS_TABLE) + " WHERE " + live())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	traces := make([]st.InterestingTrace, 0)
+	for rows.Next() {
+		var trace st.InterestingTrace
+		if err := scanRow(rows, &trace); err != nil {
+			return nil, err
+		}
+		traces = append(traces, trace)
+	}
+	return traces, rows.Err()
+}
+
+func (s *SQLiteStore) TraceSelections(traceId string) ([]st.InterestingTrace, error) {
+	live, err := s.traceSelections(s.db.Query, SELECTIONS_TABLE, traceId)
+	if err != nil {
+		return nil, err
+	}
+	archived, err := s.traceSelections(s.db.Query, SELECTION_ARCHIVE_TABLE, traceId)
+	if err != nil {
+		return nil, err
+	}
+	return mergeSelections(live, archived), nil
+}
+
+func (s *SQLiteStore) traceSelections(query func(string, ...interface{}) (*sql.Rows, error), table string, traceId string) ([]st.InterestingTrace, error) {
+	rows, err := query("SELECT "+selectColumns(st.InterestingTrace{})+" FROM "+sqliteTable(table)+" WHERE trace_id = ? AND "+live()+" ORDER BY reason", traceId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	traces := make([]st.InterestingTrace, 0)
+	for rows.Next() {
+		var trace st.InterestingTrace
+		if err := scanRow(rows, &trace); err != nil {
+			return nil, err
+		}
+		traces = append(traces, trace)
+	}
+	return traces, rows.Err()
+}
+
+func (s *SQLiteStore) DeleteSelection(traceId string, reason string) error {
+	_, err := s.db.Exec("DELETE FROM "+sqliteTable(SELECTIONS_TABLE)+" WHERE trace_id = ? AND reason = ?", traceId, reason)
+	return err
+}
+
+func (s *SQLiteStore) ArchiveTrace(traceId string, ttl int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	live, err := s.traceSelections(tx.Query, SELECTIONS_TABLE, traceId)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, trace := range live {
+		if err := upsert(tx.Exec, SELECTION_ARCHIVE_TABLE, trace, ttl); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM "+sqliteTable(SELECTIONS_TABLE)+" WHERE trace_id = ?", traceId); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) ExportStatus(traceId string, destination string) (*st.ExportStatus, error) {
+	status := st.ExportStatus{}
+	row := s.db.QueryRow("SELECT "+selectColumns(status)+" FROM "+sqliteTable(EXPORT_STATUS_TABLE)+" WHERE trace_id = ? AND destination = ? AND "+live(), traceId, destination)
+	err := scanRow(row, &status)
+	if err == sql.ErrNoRows {
+		return st.NewExportStatus(traceId, destination), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+func (s *SQLiteStore) ExportStatuses(traceId string) ([]st.ExportStatus, error) {
+	rows, err := s.db.Query("SELECT "+selectColumns(st.ExportStatus{})+" FROM "+sqliteTable(EXPORT_STATUS_TABLE)+" WHERE trace_id = ? AND "+live(), traceId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	statuses := make([]st.ExportStatus, 0)
+	for rows.Next() {
+		var status st.ExportStatus
+		if err := scanRow(rows, &status); err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, rows.Err()
+}
+
+func (s *SQLiteStore) SaveExportStatus(status *st.ExportStatus, ttl int) error {
+	return upsert(s.db.Exec, EXPORT_STATUS_TABLE, *status, ttl)
+}
+
+func (s *SQLiteStore) SaveError(e *st.Error) error {
+	return upsert(s.db.Exec, ERRORS_TABLE, *e, 0)
+}
+
+// errorsWhere gives the where clause and values for an error filter.
+func errorsWhere(filter ErrorFilter) (string, []interface{}) {
+	where := "timestamp >= ? AND timestamp <= ? AND " + live()
+	values := []interface{}{filter.From.UnixNano(), filter.To.UnixNano()}
+	for column, value := range map[string]string{
+		"component":  filter.Component,
+		"event":      filter.Event,
+		"message_id": filter.MessageId,
+	} {
+		if value != "" {
+			where += " AND " + column + " = ?"
+			values = append(values, value)
+		}
+	}
+	return where, values
+}
+
+func (s *SQLiteStore) FindErrors(filter ErrorFilter) ([]st.Error, error) {
+	where, values := errorsWhere(filter)
+	query := "SELECT " + selectColumns(st.Error{}) + " FROM " + sqliteTable(ERRORS_TABLE) + " WHERE " + where + " ORDER BY timestamp DESC"
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		values = append(values, filter.Limit)
+	}
+	rows, err := s.db.Query(query, values...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	errs := make([]st.Error, 0)
+	for rows.Next() {
+		var e st.Error
+		if err := scanRow(rows, &e); err != nil {
+			return nil, err
+		}
+		errs = append(errs, e)
+	}
+	return errs, rows.Err()
+}
+
+func (s *SQLiteStore) ErrorCounts(filter ErrorFilter) (map[string]int, error) {
+	where, values := errorsWhere(filter)
+	rows, err := s.db.Query("SELECT component, COUNT(*) FROM "+sqliteTable(ERRORS_TABLE)+" WHERE "+where+" GROUP BY component", values...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make(map[string]int)
+	for rows.Next() {
+		var component string
+		var count int
+		if err := rows.Scan(&component, &count); err != nil {
+			return nil, err
+		}
+		counts[component] = count
+	}
+	return counts, rows.Err()
+}
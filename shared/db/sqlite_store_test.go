@@ -0,0 +1,80 @@
+//go:build sqlite
+// +build sqlite
+
+package shared
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	st "shared/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func openTestSQLiteStore(t *testing.T) *SQLiteStore {
+	store, err := NewSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+	assert.Nil(t, err)
+	return store
+}
+
+func TestSQLiteStore(t *testing.T) {
+	spans := openTestSQLiteStore(t)
+	defer spans.Close()
+	testSpanStore(t, spans)
+	testSpanIndex(t, spans)
+
+	selections := openTestSQLiteStore(t)
+	defer selections.Close()
+	testTraceSelectionStore(t, selections)
+
+	errors := openTestSQLiteStore(t)
+	defer errors.Close()
+	testErrorStore(t, errors)
+}
+
+func TestSQLiteAddsColumns(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := sql.Open("sqlite3", path)
+	assert.Nil(t, err)
+	// as created before errors had message ids
+	_, err = db.Exec("CREATE TABLE system_errors (message TEXT, stack TEXT, timestamp INTEGER, component TEXT, event TEXT, expires_at INTEGER NOT NULL DEFAULT 0, PRIMARY KEY(component, timestamp))")
+	assert.Nil(t, err)
+	db.Close()
+
+	store, err := NewSQLiteStore(path)
+	assert.Nil(t, err)
+	defer store.Close()
+	e := st.NewError("uh oh", "", "span-recorder", "insert")
+	e.MessageId = "m1"
+	assert.Nil(t, store.SaveError(e))
+	errs, err := store.FindErrors(ErrorFilter{Component: "span-recorder", From: e.Timestamp, To: e.Timestamp})
+	assert.Nil(t, err)
+	assert.Equal(t, len(errs), 1)
+	assert.Equal(t, errs[0].MessageId, "m1")
+}
+
+func TestSQLiteExpiry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewSQLiteStore(path)
+	assert.Nil(t, err)
+	assert.Empty(t, store.WriteSpans([]st.SpanRow{
+		{SpanRecord: st.SpanRecord{TraceId: "t1", SpanId: "expired"}},
+		{SpanRecord: st.SpanRecord{TraceId: "t1", SpanId: "kept"}},
+	}, 0))
+	_, err = store.db.Exec("UPDATE spans SET expires_at = 1 WHERE span_id = 'expired'")
+	assert.Nil(t, err)
+
+	count, err := store.CountSpans("t1")
+	assert.Nil(t, err)
+	assert.Equal(t, count, 1, "should hide expired rows")
+	store.Close()
+
+	store, err = NewSQLiteStore(path)
+	assert.Nil(t, err)
+	defer store.Close()
+	var rows int
+	assert.Nil(t, store.db.QueryRow("SELECT COUNT(*) FROM spans").Scan(&rows))
+	assert.Equal(t, rows, 1, "should clean out expired rows on open")
+}
@@ -0,0 +1,201 @@
+package shared
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	sc "shared/config"
+	st "shared/types"
+)
+
+// SpanStore keeps spans as they come in, so traces can be put back together
+// once they are selected.
+type SpanStore interface {
+	// WriteSpans stores spans to be kept for ttl seconds. Any spans that
+	// couldn't be written are reported in the errors, the rest are kept.
+	WriteSpans(rows []st.SpanRow, ttl int) []error
+	TraceSpans(traceId string) ([]st.SpanRow, error)
+	CountSpans(traceId string) (int, error)
+}
+
+// SpanIndex keeps lookup tables for finding spans by entity, name or tag
+// value without scanning every span.
+type SpanIndex interface {
+	// IndexSpans stores summaries of spans, and of the tags on them worth
+	// searching by, to be kept for ttl seconds.
+	IndexSpans(spans []st.SpanSummary, tags []st.TaggedSpanSummary, ttl int) []error
+	// FindSpans lists up to limit spans from one hour of a lookup table that
+	// started between from and to (milliseconds, inclusive), most recent
+	// first.
+	FindSpans(lookup Lookup, hour int64, from float64, to float64, limit int) ([]st.SpanSummary, error)
+	Entities() ([]string, error)
+	SpanNames(entityName string) ([]string, error)
+}
+
+// Lookup picks the lookup table to find spans in: by tag value when Tag is
+// set, by span name when Name is, otherwise by entity.
+type Lookup struct {
+	EntityName string
+	Name       string
+	Tag        string
+	Value      string
+}
+
+func (l Lookup) table() string {
+	if l.Tag != "" {
+		return SPANS_BY_TAG_TABLE
+	}
+	if l.Name != "" {
+		return SPANS_BY_NAME_TABLE
+	}
+	return SPANS_BY_ENTITY_TABLE
+}
+
+// matches is for stores that filter rows themselves.
+func (l Lookup) matches(span st.SpanSummary, tag string, value string) bool {
+	switch l.table() {
+	case SPANS_BY_TAG_TABLE:
+		return tag == l.Tag && value == l.Value
+	case SPANS_BY_NAME_TABLE:
+		return span.Name == l.Name
+	}
+	return span.EntityName == l.EntityName
+}
+
+// partition gives the where clause and values for the lookup's partition.
+func (l Lookup) partition(hour int64) (string, []interface{}) {
+	switch l.table() {
+	case SPANS_BY_TAG_TABLE:
+		return "tag = ? AND value = ? AND hour = ?", []interface{}{l.Tag, l.Value, hour}
+	case SPANS_BY_NAME_TABLE:
+		return "name = ? AND hour = ?", []interface{}{l.Name, hour}
+	}
+	return "entity_name = ? AND hour = ?", []interface{}{l.EntityName, hour}
+}
+
+// TraceSelectionStore keeps the interesting set, and how exporting each
+// trace in it has gone.
+type TraceSelectionStore interface {
+	// SaveSelections stores the traces, all or nothing, for ttl seconds.
+	SaveSelections(traces []*st.InterestingTrace, ttl int) error
+	HasSelection(traceId string, reason string) (bool, error)
+	// Selections lists a row for every reason every trace was selected.
+	Selections() ([]st.InterestingTrace, error)
+	// TraceSelections lists the reasons one trace was selected, by reason,
+	// including archived ones.
+	TraceSelections(traceId string) ([]st.InterestingTrace, error)
+	DeleteSelection(traceId string, reason string) error
+	// ArchiveTrace moves every reason a trace was selected for out of the
+	// interesting set. TraceSelections keeps listing them for ttl seconds.
+	ArchiveTrace(traceId string, ttl int) error
+
+	// ExportStatus gives a new pending status if the trace hasn't been
+	// tried at the destination yet.
+	ExportStatus(traceId string, destination string) (*st.ExportStatus, error)
+	ExportStatuses(traceId string) ([]st.ExportStatus, error)
+	SaveExportStatus(status *st.ExportStatus, ttl int) error
+}
+
+// ErrorStore keeps errors reported by the services.
+type ErrorStore interface {
+	SaveError(e *st.Error) error
+	// FindErrors lists errors matching the filter, most recent first.
+	FindErrors(filter ErrorFilter) ([]st.Error, error)
+	// ErrorCounts gives how many errors match the filter, by component. The
+	// filter's limit is ignored.
+	ErrorCounts(filter ErrorFilter) (map[string]int, error)
+}
+
+// ErrorFilter picks out errors reported between From and To (inclusive).
+// Empty fields match anything.
+type ErrorFilter struct {
+	Component string
+	Event     string
+	MessageId string
+	From      time.Time
+	To        time.Time
+	// zero for no limit
+	Limit int
+}
+
+// matches is for stores that filter rows themselves.
+func (f ErrorFilter) matches(e st.Error) bool {
+	return (f.Component == "" || e.Component == f.Component) &&
+		(f.Event == "" || e.Event == f.Event) &&
+		(f.MessageId == "" || e.MessageId == f.MessageId) &&
+		!e.Timestamp.Before(f.From) &&
+		!e.Timestamp.After(f.To)
+}
+
+// newestErrors sorts errors most recent first and keeps up to limit of them.
+func newestErrors(errs []st.Error, limit int) []st.Error {
+	sort.Slice(errs, func(i, j int) bool {
+		return errs[i].Timestamp.After(errs[j].Timestamp)
+	})
+	if limit > 0 && len(errs) > limit {
+		errs = errs[:limit]
+	}
+	return errs
+}
+
+// mergeSelections lists a trace's live and archived reasons by reason. A
+// reason that is in both is the live one, the trace was selected again.
+func mergeSelections(live []st.InterestingTrace, archived []st.InterestingTrace) []st.InterestingTrace {
+	byReason := make(map[string]st.InterestingTrace)
+	for _, trace := range archived {
+		byReason[trace.Reason] = trace
+	}
+	for _, trace := range live {
+		byReason[trace.Reason] = trace
+	}
+	traces := make([]st.InterestingTrace, 0, len(byReason))
+	for _, trace := range byReason {
+		traces = append(traces, trace)
+	}
+	sort.Slice(traces, func(i, j int) bool {
+		return traces[i].Reason < traces[j].Reason
+	})
+	return traces
+}
+
+// Store is everything a storage backend provides.
+type Store interface {
+	SpanStore
+	SpanIndex
+	TraceSelectionStore
+	ErrorStore
+	Close()
+}
+
+// Backend opens a store using settings from the environment.
+type Backend func() (Store, error)
+
+var backends = make(map[string]Backend)
+
+// RegisterBackend makes a backend selectable with STORAGE_BACKEND. Backends
+// built in with a build tag register themselves when they are compiled in.
+func RegisterBackend(name string, open Backend) {
+	backends[name] = open
+}
+
+// BackendFromEnv finds the backend named by STORAGE_BACKEND. A backend that
+// isn't built in can't be opened by retrying, so it's an error here rather
+// than when opening the store.
+func BackendFromEnv() (Backend, error) {
+	name := sc.String("STORAGE_BACKEND", "cassandra")
+	open, ok := backends[name]
+	if !ok {
+		built := make([]string, 0, len(backends))
+		for builtName := range backends {
+			built = append(built, builtName)
+		}
+		sort.Strings(built)
+		return nil, fmt.Errorf(
+			"unknown storage backend %q, this build supports %s (sqlite needs a build with -tags sqlite, the Docker images only support cassandra)",
+			name, strings.Join(built, ", "),
+		)
+	}
+	return open, nil
+}
@@ -0,0 +1,224 @@
+package shared
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	st "shared/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// the behaviour every store implementation should share
+
+func testSpanStore(t *testing.T, store SpanStore) {
+	rows := []st.SpanRow{
+		{SpanRecord: *st.SpanToRecord(st.Span{TraceId: "t1", SpanId: "b", Name: "child", Tags: map[string]interface{}{"http.status_code": 500}}), EntityName: "e"},
+		{SpanRecord: *st.SpanToRecord(st.Span{TraceId: "t1", SpanId: "a", Name: "root"}), EntityName: "e", LicenseKey: "key"},
+		{SpanRecord: *st.SpanToRecord(st.Span{TraceId: "t2", SpanId: "c"}), EntityName: "f"},
+	}
+	assert.Empty(t, store.WriteSpans(rows, 60))
+
+	spans, err := store.TraceSpans("t1")
+	assert.Nil(t, err)
+	assert.Equal(t, len(spans), 2, "should only get spans from the trace")
+	assert.Equal(t, spans[0].SpanId, "a")
+	assert.Equal(t, spans[0].LicenseKey, "key")
+	assert.Equal(t, spans[1].NumberTags["http.status_code"], float64(500), "should keep tags")
+
+	count, err := store.CountSpans("t2")
+	assert.Nil(t, err)
+	assert.Equal(t, count, 1)
+
+	spans, err = store.TraceSpans("missing")
+	assert.Nil(t, err)
+	assert.Empty(t, spans)
+}
+
+func testSpanIndex(t *testing.T, index SpanIndex) {
+	hour := int64(10)
+	start := float64(hour * st.HOUR_MS)
+	summaries := []st.SpanSummary{
+		st.NewSpanSummary(st.Span{TraceId: "t1", SpanId: "a", Name: "GET /", StartTime: start + 100, FinishTime: start + 350}, "web"),
+		st.NewSpanSummary(st.Span{TraceId: "t1", SpanId: "b", Name: "select", StartTime: start + 200, FinishTime: start + 300}, "db"),
+		st.NewSpanSummary(st.Span{TraceId: "t2", SpanId: "c", Name: "GET /", StartTime: start + 300, FinishTime: start + 400}, "web"),
+		st.NewSpanSummary(st.Span{TraceId: "t3", SpanId: "d", Name: "GET /", StartTime: start - 100, FinishTime: start}, "web"),
+	}
+	tags := st.TagSummaries(summaries[0], map[string]interface{}{"error": true}, []string{"error"})
+	assert.Empty(t, index.IndexSpans(summaries, tags, 60))
+	assert.Empty(t, index.IndexSpans(summaries, tags, 60), "should be able to index a span again")
+
+	spans, err := index.FindSpans(Lookup{EntityName: "web"}, hour, 0, start+1000, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, len(spans), 2, "should only find spans from the entity in that hour")
+	assert.Equal(t, spans[0].SpanId, "c", "should list the most recent first")
+	assert.Equal(t, spans[0].Duration, float64(100))
+
+	spans, err = index.FindSpans(Lookup{Name: "GET /"}, hour, start+150, start+1000, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, len(spans), 1, "should only find spans in the time range")
+
+	spans, err = index.FindSpans(Lookup{Name: "GET /"}, hour-1, 0, start, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, len(spans), 1)
+	assert.Equal(t, spans[0].SpanId, "d")
+
+	spans, err = index.FindSpans(Lookup{Tag: "error", Value: "true"}, hour, 0, start+1000, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, len(spans), 1)
+	assert.Equal(t, spans[0].SpanId, "a")
+
+	spans, err = index.FindSpans(Lookup{EntityName: "web"}, hour, 0, start+1000, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, len(spans), 1, "should stop at the limit")
+
+	entities, err := index.Entities()
+	assert.Nil(t, err)
+	assert.Equal(t, entities, []string{"db", "web"})
+
+	names, err := index.SpanNames("web")
+	assert.Nil(t, err)
+	assert.Equal(t, names, []string{"GET /"})
+}
+
+func testTraceSelectionStore(t *testing.T, store TraceSelectionStore) {
+	manual := st.NewInterestingTrace("t1", "manual")
+	err := store.SaveSelections([]*st.InterestingTrace{
+		manual,
+		st.NewInterestingTrace("t1", "error"),
+		st.NewInterestingTrace("t2", "error"),
+	}, 60)
+	assert.Nil(t, err)
+
+	found, err := store.HasSelection("t1", "manual")
+	assert.Nil(t, err)
+	assert.True(t, found)
+
+	reasons, err := store.TraceSelections("t1")
+	assert.Nil(t, err)
+	assert.Equal(t, len(reasons), 2)
+	assert.Equal(t, reasons[0].Reason, "error", "should list the reasons in order")
+	assert.Equal(t, reasons[1].Reason, "manual")
+
+	assert.Nil(t, store.DeleteSelection("t1", "manual"))
+	found, err = store.HasSelection("t1", "manual")
+	assert.Nil(t, err)
+	assert.False(t, found, "should drop the one reason")
+
+	assert.Nil(t, store.ArchiveTrace("t2", 60))
+	selections, err := store.Selections()
+	assert.Nil(t, err)
+	assert.Equal(t, len(selections), 1, "should drop every reason for the trace")
+	assert.Equal(t, selections[0].TraceId, "t1")
+	assert.Equal(t, selections[0].Reason, "error")
+	reasons, err = store.TraceSelections("t2")
+	assert.Nil(t, err)
+	assert.Equal(t, len(reasons), 1, "should keep archived reasons")
+	assert.Equal(t, reasons[0].Reason, "error")
+
+	// selected again after being archived
+	assert.Nil(t, store.SaveSelections([]*st.InterestingTrace{st.NewInterestingTrace("t2", "manual")}, 60))
+	reasons, err = store.TraceSelections("t2")
+	assert.Nil(t, err)
+	assert.Equal(t, len(reasons), 2, "should list live and archived reasons")
+	assert.Equal(t, reasons[1].Reason, "manual")
+
+	status, err := store.ExportStatus("t1", "newrelic")
+	assert.Nil(t, err)
+	assert.Equal(t, status.Status, st.STATUS_PENDING, "should start out pending")
+
+	status.Status = st.STATUS_EXPORTED
+	status.ExportedSpanIds = []string{"a"}
+	status.UpdatedAt = time.Now()
+	assert.Nil(t, store.SaveExportStatus(status, 60))
+	saved, err := store.ExportStatus("t1", "newrelic")
+	assert.Nil(t, err)
+	assert.Equal(t, saved.Status, st.STATUS_EXPORTED)
+	assert.Equal(t, saved.ExportedSpanIds, []string{"a"})
+
+	statuses, err := store.ExportStatuses("t1")
+	assert.Nil(t, err)
+	assert.Equal(t, len(statuses), 1)
+}
+
+func errorMessages(errs []st.Error) []string {
+	messages := make([]string, len(errs))
+	for i, e := range errs {
+		messages[i] = e.Message
+	}
+	return messages
+}
+
+func testErrorStore(t *testing.T, store ErrorStore) {
+	start := time.Now().Add(-time.Hour)
+	for i, e := range []*st.Error{
+		st.NewError("first", "", "span-recorder", "insert"),
+		st.NewError("second", "", "span-recorder", "index"),
+		st.NewError("third", "", "trace-selector", "insert"),
+		st.NewError("fourth", "", "span-recorder", "insert"),
+	} {
+		e.Timestamp = start.Add(time.Duration(i) * time.Minute)
+		e.MessageId = fmt.Sprintf("m%d", i%2)
+		assert.Nil(t, store.SaveError(e))
+	}
+	all := ErrorFilter{From: start, To: start.Add(time.Hour)}
+
+	errs, err := store.FindErrors(all)
+	assert.Nil(t, err)
+	assert.Equal(t, errorMessages(errs), []string{"fourth", "third", "second", "first"}, "should list the most recent first")
+	assert.Equal(t, errs[0].MessageId, "m1")
+
+	filter := all
+	filter.Limit = 2
+	errs, _ = store.FindErrors(filter)
+	assert.Equal(t, errorMessages(errs), []string{"fourth", "third"})
+
+	filter = all
+	filter.Component = "span-recorder"
+	filter.Event = "insert"
+	errs, _ = store.FindErrors(filter)
+	assert.Equal(t, errorMessages(errs), []string{"fourth", "first"})
+
+	filter = all
+	filter.MessageId = "m0"
+	errs, _ = store.FindErrors(filter)
+	assert.Equal(t, errorMessages(errs), []string{"third", "first"})
+
+	filter = all
+	filter.From = start.Add(90 * time.Second)
+	filter.To = start.Add(2 * time.Minute)
+	errs, _ = store.FindErrors(filter)
+	assert.Equal(t, errorMessages(errs), []string{"third"}, "should only list errors in the time range")
+
+	counts, err := store.ErrorCounts(all)
+	assert.Nil(t, err)
+	assert.Equal(t, counts, map[string]int{"span-recorder": 3, "trace-selector": 1})
+
+	filter = all
+	filter.Event = "insert"
+	counts, _ = store.ErrorCounts(filter)
+	assert.Equal(t, counts, map[string]int{"span-recorder": 2, "trace-selector": 1})
+}
+
+func TestMemoryStore(t *testing.T) {
+	testSpanStore(t, NewMemoryStore())
+	testSpanIndex(t, NewMemoryStore())
+	testTraceSelectionStore(t, NewMemoryStore())
+
+	testErrorStore(t, NewMemoryStore())
+}
+
+func TestBackendFromEnv(t *testing.T) {
+	open, err := BackendFromEnv()
+	assert.Nil(t, err)
+	assert.NotNil(t, open, "should default to cassandra")
+
+	os.Setenv("STORAGE_BACKEND", "nonsense")
+	defer os.Unsetenv("STORAGE_BACKEND")
+	_, err = BackendFromEnv()
+	assert.NotNil(t, err, "should not find a backend that isn't built in")
+	assert.Contains(t, err.Error(), `"nonsense"`)
+	assert.Contains(t, err.Error(), "cassandra", "should say which backends are built in")
+}
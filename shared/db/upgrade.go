@@ -0,0 +1,402 @@
+package shared
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gocql/gocql"
+)
+
+var createTablePattern = regexp.MustCompile(`^CREATE TABLE IF NOT EXISTS (\S+) \((.*), PRIMARY KEY\((.*)\)\)( WITH .*)?;$`)
+
+// splitColumns splits a column list on commas that aren't inside a type
+// like map<text, text>.
+func splitColumns(list string) []string {
+	columns := make([]string, 0)
+	depth := 0
+	start := 0
+	for i, c := range list {
+		switch c {
+		case '<':
+			depth++
+		case '>':
+			depth--
+		case ',':
+			if depth == 0 {
+				columns = append(columns, strings.TrimSpace(list[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(columns, strings.TrimSpace(list[start:]))
+}
+
+// tableLayout is what a table's rows look like, as far as telling whether
+// they can be written to goes.
+type tableLayout struct {
+	PartitionKey []string
+	Clustering   []string
+	// column name -> type
+	Columns map[string]string
+}
+
+// normalizeType lets types be compared however they were written, e.g.
+// map<text,Boolean> and map<text, boolean>.
+func normalizeType(t string) string {
+	return strings.ToLower(strings.Replace(t, " ", "", -1))
+}
+
+// parsePrimaryKey splits e.g. "(entity_name, hour), start_time" into its
+// partition and clustering columns.
+func parsePrimaryKey(keys string) ([]string, []string) {
+	keys = strings.TrimSpace(keys)
+	var partition string
+	var rest string
+	if strings.HasPrefix(keys, "(") {
+		end := strings.Index(keys, ")")
+		partition = keys[1:end]
+		rest = strings.TrimPrefix(strings.TrimSpace(keys[end+1:]), ",")
+	} else {
+		parts := strings.SplitN(keys, ",", 2)
+		partition = parts[0]
+		if len(parts) > 1 {
+			rest = parts[1]
+		}
+	}
+	split := func(list string) []string {
+		columns := make([]string, 0)
+		for _, c := range strings.Split(list, ",") {
+			if c = strings.TrimSpace(c); c != "" {
+				columns = append(columns, c)
+			}
+		}
+		return columns
+	}
+	return split(partition), split(rest)
+}
+
+// parseCreateTable reads the table name and layout out of a CREATE TABLE
+// statement like the ones in MIGRATIONS.
+func parseCreateTable(statement string) (string, *tableLayout, error) {
+	match := createTablePattern.FindStringSubmatch(statement)
+	if match == nil {
+		return "", nil, fmt.Errorf("not a CREATE TABLE statement: %s", statement)
+	}
+	layout := &tableLayout{Columns: make(map[string]string)}
+	for _, column := range splitColumns(match[2]) {
+		parts := strings.SplitN(column, " ", 2)
+		layout.Columns[parts[0]] = normalizeType(parts[1])
+	}
+	layout.PartitionKey, layout.Clustering = parsePrimaryKey(match[3])
+	return match[1], layout, nil
+}
+
+func (l *tableLayout) sameKey(other *tableLayout) bool {
+	return reflect.DeepEqual(l.PartitionKey, other.PartitionKey) && reflect.DeepEqual(l.Clustering, other.Clustering)
+}
+
+func (l *tableLayout) isKey(column string) bool {
+	for _, key := range append(append([]string{}, l.PartitionKey...), l.Clustering...) {
+		if key == column {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *tableLayout) key() string {
+	return "(" + strings.Join(l.PartitionKey, ", ") + "), " + strings.Join(l.Clustering, ", ")
+}
+
+// readLayout looks a table up in the system schema. It gives nil if the
+// table doesn't exist.
+func readLayout(session *gocql.Session, table string) (*tableLayout, error) {
+	parts := strings.SplitN(table, ".", 2)
+	iter := session.Query(
+		"SELECT column_name, kind, position, type FROM system_schema.columns WHERE keyspace_name = ? AND table_name = ?",
+		parts[0],
+		parts[1],
+	).Iter()
+	layout := &tableLayout{Columns: make(map[string]string)}
+	partition := make(map[int]string)
+	clustering := make(map[int]string)
+	var name, kind, columnType string
+	var position int
+	for iter.Scan(&name, &kind, &position, &columnType) {
+		layout.Columns[name] = normalizeType(columnType)
+		switch kind {
+		case "partition_key":
+			partition[position] = name
+		case "clustering":
+			clustering[position] = name
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	if len(layout.Columns) == 0 {
+		return nil, nil
+	}
+	ordered := func(columns map[int]string) []string {
+		list := make([]string, len(columns))
+		for position, name := range columns {
+			list[position] = name
+		}
+		return list
+	}
+	layout.PartitionKey = ordered(partition)
+	layout.Clustering = ordered(clustering)
+	return layout, nil
+}
+
+// upgradePlan is how to bring a table as it is in line with the layout a
+// migration expects.
+type upgradePlan struct {
+	// the primary key is different, so the rows have to be copied into a
+	// new table
+	Rebuild bool
+	// columns to add, when the table doesn't need rebuilding
+	Missing []string
+	// columns to copy across, when it does
+	Copied []string
+	// columns the migration doesn't know about (e.g. added by a later one)
+	// to keep when rebuilding
+	Carried []string
+}
+
+// planUpgrade works out an upgradePlan. Rows can only be copied into the new
+// table if there is a value for each column of its primary key, either from
+// the old table or from defaults.
+func planUpgrade(existing *tableLayout, target *tableLayout, defaults map[string]interface{}) (*upgradePlan, error) {
+	plan := &upgradePlan{
+		Rebuild: !existing.sameKey(target),
+		Missing: make([]string, 0),
+		Copied:  make([]string, 0),
+		Carried: make([]string, 0),
+	}
+	for column, columnType := range target.Columns {
+		existingType, ok := existing.Columns[column]
+		switch {
+		case !ok:
+			plan.Missing = append(plan.Missing, column)
+			_, hasDefault := defaults[column]
+			if plan.Rebuild && target.isKey(column) && !hasDefault {
+				return nil, fmt.Errorf("no value for %s to move rows into the new primary key", column)
+			}
+		case existingType != columnType:
+			if !plan.Rebuild {
+				return nil, fmt.Errorf("%s is a %s, expected %s", column, existingType, columnType)
+			}
+			// old values can't be carried over
+			log.Printf("dropping %s, it is a %s rather than a %s", column, existingType, columnType)
+		default:
+			plan.Copied = append(plan.Copied, column)
+		}
+	}
+	for column := range existing.Columns {
+		if _, ok := target.Columns[column]; !ok && !existing.isKey(column) {
+			plan.Carried = append(plan.Carried, column)
+		}
+	}
+	sort.Strings(plan.Missing)
+	sort.Strings(plan.Copied)
+	sort.Strings(plan.Carried)
+	if !plan.Rebuild {
+		plan.Copied = plan.Copied[:0]
+		plan.Carried = plan.Carried[:0]
+	}
+	return plan, nil
+}
+
+// copyRows copies columns from one table to another, filling in defaults
+// for columns the first doesn't have.
+func copyRows(session *gocql.Session, from string, to string, columns []string, defaults map[string]interface{}) (int, error) {
+	insertColumns := append([]string{}, columns...)
+	for column := range defaults {
+		insertColumns = append(insertColumns, column)
+	}
+	placeholders := make([]string, len(insertColumns))
+	for i := range placeholders {
+		placeholders[i] = "?"
+	}
+	insert := "INSERT INTO " + to + " (" + strings.Join(insertColumns, ", ") + ") VALUES (" + strings.Join(placeholders, ", ") + ")"
+
+	iter := session.Query("SELECT " + strings.Join(columns, ", ") + " FROM " + from).PageSize(500).Iter()
+	copied := 0
+	row := make(map[string]interface{})
+	for iter.MapScan(row) {
+		values := make([]interface{}, len(insertColumns))
+		for i, column := range insertColumns {
+			if value, ok := defaults[column]; ok {
+				values[i] = value
+			} else {
+				values[i] = row[column]
+			}
+		}
+		if err := session.Query(insert, values...).Exec(); err != nil {
+			iter.Close()
+			return copied, err
+		}
+		copied++
+		row = make(map[string]interface{})
+	}
+	return copied, iter.Close()
+}
+
+// upgradeTable brings a table created before migrations existed in line
+// with the CREATE TABLE statement a migration would have created it with.
+// Missing columns are added, and a table with a different primary key is
+// rebuilt, its rows going through a temporary table so an upgrade that stops
+// part way can be picked up again.
+func upgradeTable(session *gocql.Session, statement string, defaults map[string]interface{}) error {
+	name, target, err := parseCreateTable(statement)
+	if err != nil {
+		return err
+	}
+	temp := name + "_upgrade"
+	existing, err := readLayout(session, name)
+	if err != nil {
+		return err
+	}
+
+	if existing != nil && !existing.sameKey(target) {
+		plan, err := planUpgrade(existing, target, defaults)
+		if err != nil {
+			return fmt.Errorf("can't upgrade %s from the primary key %s: %v, drop it to start it over empty", name, existing.key(), err)
+		}
+		log.Printf("%s has the primary key %s rather than %s, rebuilding it", name, existing.key(), target.key())
+		tempStatement := strings.Replace(statement, " "+name+" ", " "+temp+" ", 1)
+		for _, s := range []string{"DROP TABLE IF EXISTS " + temp, tempStatement} {
+			if err := session.Query(s).Exec(); err != nil {
+				return err
+			}
+		}
+		for _, column := range plan.Carried {
+			if err := session.Query("ALTER TABLE " + temp + " ADD " + column + " " + existing.Columns[column]).Exec(); err != nil {
+				return err
+			}
+		}
+		columnDefaults := make(map[string]interface{})
+		for _, column := range plan.Missing {
+			if value, ok := defaults[column]; ok {
+				columnDefaults[column] = value
+			}
+		}
+		copied, err := copyRows(session, name, temp, append(plan.Copied, plan.Carried...), columnDefaults)
+		if err != nil {
+			return err
+		}
+		log.Printf("copied %d rows out of %s", copied, name)
+		if err := session.Query("DROP TABLE " + name).Exec(); err != nil {
+			return err
+		}
+		existing = nil
+	}
+
+	tempLayout, err := readLayout(session, temp)
+	if err != nil {
+		return err
+	}
+	if tempLayout != nil {
+		// the old table is gone, move the rows into the new one
+		if err := session.Query(statement).Exec(); err != nil {
+			return err
+		}
+		if existing, err = readLayout(session, name); err != nil {
+			return err
+		}
+		columns := make([]string, 0)
+		for column, columnType := range tempLayout.Columns {
+			columns = append(columns, column)
+			if _, ok := existing.Columns[column]; ok {
+				continue
+			}
+			if err := session.Query("ALTER TABLE " + name + " ADD " + column + " " + columnType).Exec(); err != nil {
+				return err
+			}
+		}
+		sort.Strings(columns)
+		copied, err := copyRows(session, temp, name, columns, nil)
+		if err != nil {
+			return err
+		}
+		log.Printf("copied %d rows into %s", copied, name)
+		return session.Query("DROP TABLE " + temp).Exec()
+	}
+
+	if existing == nil {
+		return nil
+	}
+	plan, err := planUpgrade(existing, target, defaults)
+	if err != nil {
+		return fmt.Errorf("can't upgrade %s: %v", name, err)
+	}
+	for _, column := range plan.Missing {
+		log.Printf("adding %s to %s", column, name)
+		if err := session.Query("ALTER TABLE " + name + " ADD " + column + " " + target.Columns[column]).Exec(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// legacyDefaults fills in key columns that tables created before migrations
+// didn't have. interesting_traces used to only hold traces from the anomaly
+// detector.
+var legacyDefaults = map[string]map[string]interface{}{
+	SELECTIONS_TABLE: {"reason": "anomaly"},
+}
+
+// upgradeLegacyTables brings the tables services created for themselves,
+// before there were migrations, in line with the first migration.
+func upgradeLegacyTables(session *gocql.Session) error {
+	for _, statement := range createTables {
+		name, _, err := parseCreateTable(statement)
+		if err != nil {
+			return err
+		}
+		if err := upgradeTable(session, statement, legacyDefaults[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VerifyTables checks the tables in keyspace can be written to from their
+// structs, so a table left over with a different primary key or missing
+// columns fails loudly instead of failing every write.
+func VerifyTables(session *gocql.Session, keyspace string, tables []Table) error {
+	for _, table := range tables {
+		if !strings.HasPrefix(table.Name, keyspace+".") {
+			continue
+		}
+		_, expected, err := parseCreateTable(table.Schema())
+		if err != nil {
+			return err
+		}
+		existing, err := readLayout(session, table.Name)
+		if err != nil {
+			return err
+		}
+		if existing == nil {
+			return fmt.Errorf("%s does not exist", table.Name)
+		}
+		if !existing.sameKey(expected) {
+			return fmt.Errorf("%s has the primary key %s, expected %s", table.Name, existing.key(), expected.key())
+		}
+		for column, columnType := range expected.Columns {
+			existingType, ok := existing.Columns[column]
+			if !ok {
+				return fmt.Errorf("%s is missing the column %s", table.Name, column)
+			}
+			if existingType != columnType {
+				return fmt.Errorf("%s.%s is a %s, expected %s", table.Name, column, existingType, columnType)
+			}
+		}
+	}
+	return nil
+}
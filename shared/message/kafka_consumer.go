@@ -43,3 +43,38 @@ func (k *SpanMessageConsumer) Start(msgChan chan st.SpanMessage) {
 		}
 	}()
 }
+
+type TraceSelectionConsumer struct {
+	reader *kafka.Reader
+}
+
+func NewTraceSelectionConsumer(consumerGroup string) *TraceSelectionConsumer {
+	return &TraceSelectionConsumer{
+		reader: kafka.NewReader(kafka.ReaderConfig{
+			Brokers:   []string{"kafka:9092"},
+			GroupID:   consumerGroup,
+			Topic:     "selectedTraces",
+			Partition: 0,
+			MaxBytes:  10e6, // 10MB
+		}),
+	}
+}
+
+func (k *TraceSelectionConsumer) Start(selectionChan chan st.TraceSelection) {
+	go func() {
+		for {
+			m, err := k.reader.ReadMessage(context.Background())
+			if err != nil {
+				fmt.Printf("Consumer error: %v (%v)\n", err, m)
+				close(selectionChan)
+				log.Fatal("dying")
+			}
+			var selection st.TraceSelection
+			if err := json.Unmarshal(m.Value, &selection); err != nil {
+				log.Print("could not parse trace selection: ", err)
+				continue
+			}
+			selectionChan <- selection
+		}
+	}()
+}
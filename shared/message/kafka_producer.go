@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"log"
+	"time"
 
 	st "shared/types"
 
@@ -42,6 +43,45 @@ func (k *ErrorMessageProducer) Write(messageId string, msgErr *st.Error) error {
 	return nil
 }
 
+type TraceSelectionProducer struct {
+	writer *kafka.Writer
+}
+
+func NewTraceSelectionProducer() *TraceSelectionProducer {
+	return &TraceSelectionProducer{
+		writer: kafka.NewWriter(kafka.WriterConfig{
+			Brokers:  []string{"kafka:9092"},
+			Topic:    "selectedTraces",
+			Balancer: &kafka.LeastBytes{},
+			// writes wait for the batch to fill or time out, and selections
+			// are written a batch at a time already
+			BatchTimeout: 10 * time.Millisecond,
+		}),
+	}
+}
+
+// Write publishes selections in one go.
+func (k *TraceSelectionProducer) Write(selections ...*st.TraceSelection) error {
+	msgs := make([]kafka.Message, len(selections))
+	for i, selection := range selections {
+		msg, err := json.Marshal(selection)
+		if err != nil {
+			return err
+		}
+		msgs[i] = kafka.Message{
+			Key:   []byte(selection.TraceId),
+			Value: []byte(msg),
+		}
+	}
+	return k.writer.WriteMessages(context.Background(), msgs...)
+}
+
+// ErrorReporter is where services send errors, so tests can stand in for
+// the errors topic.
+type ErrorReporter interface {
+	HandleErr(messageId *string, err error, event string)
+}
+
 type ErrorHandler struct {
 	errWriter   *ErrorMessageProducer
 	errProducer *st.ErrorProducer
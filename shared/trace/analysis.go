@@ -0,0 +1,112 @@
+package shared
+
+import (
+	"math"
+	"sort"
+)
+
+// Segment is a stretch of time on the critical path, and the span that was
+// doing the work during it.
+type Segment struct {
+	SpanId string  `json:"span_id"`
+	Start  float64 `json:"start"`
+	Finish float64 `json:"finish"`
+}
+
+// SelfTimes gives each span's exclusive time: how long it ran without any of
+// its children running. Children running in parallel are only counted once,
+// and any part of a child outside its parent is ignored.
+func (t *Trace) SelfTimes() map[string]float64 {
+	selfTimes := make(map[string]float64, len(t.Nodes))
+	for spanId, node := range t.Nodes {
+		selfTimes[spanId] = selfTime(node)
+	}
+	return selfTimes
+}
+
+func selfTime(node *Node) float64 {
+	start := node.Span.StartTime
+	finish := node.Span.FinishTime
+	duration := math.Max(finish-start, 0)
+
+	intervals := make([][2]float64, 0, len(node.Children))
+	for _, child := range node.Children {
+		childStart := math.Max(child.Span.StartTime, start)
+		childFinish := math.Min(child.Span.FinishTime, finish)
+		if childFinish > childStart {
+			intervals = append(intervals, [2]float64{childStart, childFinish})
+		}
+	}
+	sort.Slice(intervals, func(i, j int) bool {
+		return intervals[i][0] < intervals[j][0]
+	})
+
+	covered := 0.0
+	cursor := start
+	for _, interval := range intervals {
+		from := math.Max(interval[0], cursor)
+		if interval[1] > from {
+			covered += interval[1] - from
+			cursor = interval[1]
+		}
+	}
+	return duration - covered
+}
+
+// CriticalPath gives the chain of work that determined how long the trace
+// took, in time order. Working back from the end of each span, the child that
+// finished last is what the span was waiting on; any time not spent waiting
+// on a child is the span's own. Traces without a single root have no
+// critical path.
+func (t *Trace) CriticalPath() []Segment {
+	root, ok := t.Root()
+	if !ok {
+		return nil
+	}
+	segments := make([]Segment, 0)
+	criticalPath(root, root.Span.FinishTime, &segments)
+	// segments were found working backwards
+	for i, j := 0, len(segments)-1; i < j; i, j = i+1, j-1 {
+		segments[i], segments[j] = segments[j], segments[i]
+	}
+	return segments
+}
+
+func criticalPath(node *Node, end float64, segments *[]Segment) {
+	start := node.Span.StartTime
+	cursor := math.Min(node.Span.FinishTime, end)
+
+	children := make([]*Node, len(node.Children))
+	copy(children, node.Children)
+	sort.SliceStable(children, func(i, j int) bool {
+		return children[i].Span.FinishTime > children[j].Span.FinishTime
+	})
+
+	for _, child := range children {
+		if cursor <= start {
+			break
+		}
+		if child.Span.StartTime >= cursor {
+			continue
+		}
+		childEnd := math.Min(child.Span.FinishTime, cursor)
+		if childEnd < cursor {
+			*segments = append(*segments, Segment{node.Span.SpanId, childEnd, cursor})
+		}
+		criticalPath(child, childEnd, segments)
+		cursor = math.Max(child.Span.StartTime, start)
+	}
+	if cursor > start {
+		*segments = append(*segments, Segment{node.Span.SpanId, start, cursor})
+	}
+}
+
+// CriticalTimes sums up how long each span spent on the critical path.
+// Spans that aren't on it are left out.
+func (t *Trace) CriticalTimes() map[string]float64 {
+	criticalTimes := make(map[string]float64)
+	for _, segment := range t.CriticalPath() {
+		criticalTimes[segment.SpanId] += segment.Finish - segment.Start
+	}
+	return criticalTimes
+}
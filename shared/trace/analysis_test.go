@@ -0,0 +1,72 @@
+package shared
+
+import (
+	"testing"
+
+	st "shared/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelfTimes(t *testing.T) {
+	trace := Assemble([]st.Span{
+		span("root", "", 0, 100),
+		// b and c overlap, so 10-50 is only counted once
+		span("b", "root", 10, 40),
+		span("c", "root", 30, 50),
+		// d runs past the end of root
+		span("d", "root", 90, 120),
+		span("e", "b", 15, 20),
+	})
+	assert.Equal(t, trace.SelfTimes(), map[string]float64{
+		"root": 50,
+		"b":    25,
+		"c":    20,
+		"d":    30,
+		"e":    5,
+	})
+}
+
+func TestCriticalPath(t *testing.T) {
+	trace := Assemble([]st.Span{
+		span("root", "", 0, 100),
+		span("fast", "root", 10, 30),
+		span("slow", "root", 10, 60),
+		span("db", "slow", 20, 50),
+		span("render", "root", 70, 90),
+	})
+	assert.Equal(t, trace.CriticalPath(), []Segment{
+		{"root", 0, 10},
+		{"slow", 10, 20},
+		{"db", 20, 50},
+		{"slow", 50, 60},
+		{"root", 60, 70},
+		{"render", 70, 90},
+		{"root", 90, 100},
+	}, "should follow the last child to finish")
+	assert.Equal(t, trace.CriticalTimes(), map[string]float64{
+		"root":   30,
+		"slow":   20,
+		"db":     30,
+		"render": 20,
+	}, "should leave out spans that weren't waited on")
+}
+
+func TestCriticalPathClipsChildren(t *testing.T) {
+	trace := Assemble([]st.Span{
+		span("root", "", 0, 100),
+		span("async", "root", 50, 150),
+	})
+	assert.Equal(t, trace.CriticalPath(), []Segment{
+		{"root", 0, 50},
+		{"async", 50, 100},
+	}, "should not go past the end of the parent")
+}
+
+func TestCriticalPathWithoutRoot(t *testing.T) {
+	trace := Assemble([]st.Span{
+		span("a", "", 0, 10),
+		span("b", "", 0, 10),
+	})
+	assert.Nil(t, trace.CriticalPath())
+}
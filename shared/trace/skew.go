@@ -0,0 +1,63 @@
+package shared
+
+// the tag recording how far a span was moved to correct for clock skew
+const SKEW_OFFSET_TAG = "clock_skew.offset_ms"
+
+// AdjustSkew corrects for clocks disagreeing between hosts, the way Zipkin
+// does. Wherever a client span calls into another entity and the callee's
+// spans don't fit inside it, the callee's subtree is moved to fit: centered
+// in the client span, or lined up with its start if it is longer. Every span
+// moved gets the offset applied (in milliseconds) recorded as a tag, and the
+// offsets are returned by span id.
+//
+// entityOf gives the entity that reported a span.
+func (t *Trace) AdjustSkew(entityOf func(spanId string) string) map[string]float64 {
+	offsets := make(map[string]float64)
+	t.Walk(func(node *Node, depth int) {
+		if node.Span.Tags["span.kind"] != "client" {
+			return
+		}
+		for _, child := range node.Children {
+			if entityOf(child.Span.SpanId) == entityOf(node.Span.SpanId) {
+				continue
+			}
+			offset := skewOffset(node, child)
+			if offset != 0 {
+				shift(child, offset, offsets)
+			}
+		}
+	})
+	return offsets
+}
+
+func skewOffset(parent *Node, child *Node) float64 {
+	parentStart := parent.Span.StartTime
+	parentDuration := parent.Span.FinishTime - parentStart
+	childStart := child.Span.StartTime
+	childDuration := child.Span.FinishTime - childStart
+	if childStart >= parentStart && child.Span.FinishTime <= parent.Span.FinishTime {
+		return 0
+	}
+	if childDuration > parentDuration {
+		return parentStart - childStart
+	}
+	return parentStart + (parentDuration-childDuration)/2 - childStart
+}
+
+func shift(node *Node, offset float64, offsets map[string]float64) {
+	node.Span.StartTime += offset
+	node.Span.FinishTime += offset
+	offsets[node.Span.SpanId] += offset
+
+	// the tags may be shared with whatever the span was assembled from
+	tags := make(map[string]interface{}, len(node.Span.Tags)+1)
+	for k, v := range node.Span.Tags {
+		tags[k] = v
+	}
+	tags[SKEW_OFFSET_TAG] = offsets[node.Span.SpanId]
+	node.Span.Tags = tags
+
+	for _, child := range node.Children {
+		shift(child, offset, offsets)
+	}
+}
@@ -0,0 +1,69 @@
+package shared
+
+import (
+	"testing"
+
+	st "shared/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func clientSpan(spanId string, parentId string, start float64, finish float64) st.Span {
+	s := span(spanId, parentId, start, finish)
+	s.Tags = map[string]interface{}{"span.kind": "client"}
+	return s
+}
+
+func entities(entityOf map[string]string) func(string) string {
+	return func(spanId string) string {
+		return entityOf[spanId]
+	}
+}
+
+func TestAdjustSkew(t *testing.T) {
+	call := clientSpan("call", "root", 10, 50)
+	trace := Assemble([]st.Span{
+		span("root", "", 0, 100),
+		call,
+		// the backend's clock is 100ms ahead
+		span("server", "call", 120, 140),
+		span("query", "server", 125, 130),
+	})
+	offsets := trace.AdjustSkew(entities(map[string]string{
+		"root":   "frontend",
+		"call":   "frontend",
+		"server": "backend",
+		"query":  "backend",
+	}))
+
+	assert.Equal(t, offsets, map[string]float64{
+		"server": -100,
+		"query":  -100,
+	})
+	server := trace.Nodes["server"].Span
+	assert.Equal(t, server.StartTime, 20.0, "should center the callee in the client span")
+	assert.Equal(t, server.FinishTime, 40.0)
+	assert.Equal(t, server.Tags[SKEW_OFFSET_TAG], -100.0, "should record the offset")
+	assert.Equal(t, trace.Nodes["query"].Span.StartTime, 25.0, "should move the whole subtree")
+	assert.Nil(t, call.Tags[SKEW_OFFSET_TAG], "should not change the spans it was given")
+	assert.Nil(t, trace.Nodes["call"].Span.Tags[SKEW_OFFSET_TAG], "should leave the caller alone")
+}
+
+func TestAdjustSkewLongerCallee(t *testing.T) {
+	trace := Assemble([]st.Span{
+		clientSpan("call", "", 100, 110),
+		span("server", "call", 50, 70),
+	})
+	trace.AdjustSkew(entities(map[string]string{"call": "frontend", "server": "backend"}))
+	assert.Equal(t, trace.Nodes["server"].Span.StartTime, 100.0, "should line up with the start of the client span")
+}
+
+func TestAdjustSkewSameEntity(t *testing.T) {
+	trace := Assemble([]st.Span{
+		clientSpan("call", "", 10, 50),
+		span("server", "call", 120, 140),
+	})
+	offsets := trace.AdjustSkew(entities(map[string]string{"call": "frontend", "server": "frontend"}))
+	assert.Empty(t, offsets, "should only correct across entities")
+	assert.Equal(t, trace.Nodes["server"].Span.StartTime, 120.0)
+}
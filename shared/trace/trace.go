@@ -0,0 +1,181 @@
+package shared
+
+import (
+	"sort"
+
+	st "shared/types"
+)
+
+type Node struct {
+	Span     st.Span `json:"span"`
+	Parent   *Node   `json:"-"`
+	Children []*Node `json:"children,omitempty"`
+}
+
+// Trace is a set of spans assembled into a tree (or, when the spans don't
+// line up, a forest) by parent id.
+type Trace struct {
+	TraceId   string           `json:"trace_id"`
+	Roots     []*Node          `json:"roots"`
+	Nodes     map[string]*Node `json:"-"`
+	Integrity *IntegrityReport `json:"integrity"`
+}
+
+// IntegrityReport lists everything wrong with how a trace's spans fit
+// together. Span ids are listed for each problem.
+type IntegrityReport struct {
+	// spans without a parent id, there should be exactly one
+	Roots []string `json:"roots"`
+	// spans whose parent isn't in the trace, they are treated as roots
+	Orphans []string `json:"orphans,omitempty"`
+	// each cycle is broken at its first span, which is treated as a root
+	Cycles [][]string `json:"cycles,omitempty"`
+	// only the first span with an id is kept
+	DuplicateSpanIds []string `json:"duplicate_span_ids,omitempty"`
+	// spans that start before or finish after their parent
+	OutsideParent []string `json:"outside_parent,omitempty"`
+	// spans that belong to a different trace, they are left out
+	ForeignSpans []string `json:"foreign_spans,omitempty"`
+}
+
+func (r *IntegrityReport) MultipleRoots() bool {
+	return len(r.Roots) > 1
+}
+
+func (r *IntegrityReport) Ok() bool {
+	return len(r.Roots) == 1 &&
+		len(r.Orphans) == 0 &&
+		len(r.Cycles) == 0 &&
+		len(r.DuplicateSpanIds) == 0 &&
+		len(r.OutsideParent) == 0 &&
+		len(r.ForeignSpans) == 0
+}
+
+// Assemble builds the span tree for a trace, along with a report of anything
+// that didn't fit. The trace id is taken from the first span.
+func Assemble(spans []st.Span) *Trace {
+	t := &Trace{
+		Roots:     make([]*Node, 0),
+		Nodes:     make(map[string]*Node),
+		Integrity: &IntegrityReport{Roots: make([]string, 0)},
+	}
+	report := t.Integrity
+	if len(spans) == 0 {
+		return t
+	}
+	t.TraceId = spans[0].TraceId
+
+	ordered := make([]*Node, 0, len(spans))
+	for _, s := range spans {
+		if s.TraceId != t.TraceId {
+			report.ForeignSpans = append(report.ForeignSpans, s.SpanId)
+			continue
+		}
+		if _, ok := t.Nodes[s.SpanId]; ok {
+			report.DuplicateSpanIds = append(report.DuplicateSpanIds, s.SpanId)
+			continue
+		}
+		node := &Node{Span: s}
+		t.Nodes[s.SpanId] = node
+		ordered = append(ordered, node)
+	}
+
+	for _, node := range ordered {
+		parentId := node.Span.ParentId
+		if parentId == "" {
+			report.Roots = append(report.Roots, node.Span.SpanId)
+			t.Roots = append(t.Roots, node)
+			continue
+		}
+		parent, ok := t.Nodes[parentId]
+		if !ok {
+			report.Orphans = append(report.Orphans, node.Span.SpanId)
+			t.Roots = append(t.Roots, node)
+			continue
+		}
+		node.Parent = parent
+	}
+
+	t.breakCycles(ordered)
+
+	for _, node := range ordered {
+		if node.Parent == nil {
+			continue
+		}
+		node.Parent.Children = append(node.Parent.Children, node)
+		if node.Span.StartTime < node.Parent.Span.StartTime || node.Span.FinishTime > node.Parent.Span.FinishTime {
+			report.OutsideParent = append(report.OutsideParent, node.Span.SpanId)
+		}
+	}
+
+	sortNodes(t.Roots)
+	for _, node := range ordered {
+		sortNodes(node.Children)
+	}
+	return t
+}
+
+// breakCycles finds spans that can't reach a root by following their
+// parents, and cuts each cycle at the first of its spans.
+func (t *Trace) breakCycles(ordered []*Node) {
+	// 0 = unvisited, 1 = on the current path, 2 = reaches a root
+	state := make(map[*Node]int)
+	for _, start := range ordered {
+		if state[start] != 0 {
+			continue
+		}
+		path := make([]*Node, 0)
+		node := start
+		for node != nil && state[node] == 0 {
+			state[node] = 1
+			path = append(path, node)
+			node = node.Parent
+		}
+		if node != nil && state[node] == 1 {
+			// walked back into the current path, everything from node on
+			// is a cycle
+			cycle := make([]string, 0)
+			for i := len(path) - 1; i >= 0; i-- {
+				cycle = append([]string{path[i].Span.SpanId}, cycle...)
+				if path[i] == node {
+					break
+				}
+			}
+			t.Integrity.Cycles = append(t.Integrity.Cycles, cycle)
+			cut := t.Nodes[cycle[0]]
+			cut.Parent = nil
+			t.Roots = append(t.Roots, cut)
+		}
+		for _, n := range path {
+			state[n] = 2
+		}
+	}
+}
+
+func sortNodes(nodes []*Node) {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return nodes[i].Span.StartTime < nodes[j].Span.StartTime
+	})
+}
+
+// Root gives the root of the trace, as long as there is exactly one.
+func (t *Trace) Root() (*Node, bool) {
+	if len(t.Roots) != 1 {
+		return nil, false
+	}
+	return t.Roots[0], true
+}
+
+// Walk visits every span depth first, parents before their children.
+func (t *Trace) Walk(visit func(node *Node, depth int)) {
+	var walk func(node *Node, depth int)
+	walk = func(node *Node, depth int) {
+		visit(node, depth)
+		for _, child := range node.Children {
+			walk(child, depth+1)
+		}
+	}
+	for _, root := range t.Roots {
+		walk(root, 0)
+	}
+}
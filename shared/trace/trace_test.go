@@ -0,0 +1,96 @@
+package shared
+
+import (
+	"testing"
+
+	st "shared/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func span(spanId string, parentId string, start float64, finish float64) st.Span {
+	return st.Span{
+		TraceId:    "trace",
+		SpanId:     spanId,
+		ParentId:   parentId,
+		Name:       spanId,
+		StartTime:  start,
+		FinishTime: finish,
+	}
+}
+
+func spanIds(nodes []*Node) []string {
+	ids := make([]string, 0)
+	for _, node := range nodes {
+		ids = append(ids, node.Span.SpanId)
+	}
+	return ids
+}
+
+func TestAssemble(t *testing.T) {
+	trace := Assemble([]st.Span{
+		span("c", "a", 5, 8),
+		span("b", "a", 1, 4),
+		span("a", "", 0, 10),
+		span("d", "b", 2, 3),
+	})
+	assert.True(t, trace.Integrity.Ok(), "should be a clean trace")
+	assert.Equal(t, trace.TraceId, "trace")
+
+	root, ok := trace.Root()
+	assert.True(t, ok)
+	assert.Equal(t, root.Span.SpanId, "a")
+	assert.Equal(t, spanIds(root.Children), []string{"b", "c"}, "should order children by start time")
+	assert.Equal(t, spanIds(trace.Nodes["b"].Children), []string{"d"})
+	assert.Equal(t, trace.Nodes["d"].Parent.Span.SpanId, "b")
+
+	visited := make([]string, 0)
+	depths := make([]int, 0)
+	trace.Walk(func(node *Node, depth int) {
+		visited = append(visited, node.Span.SpanId)
+		depths = append(depths, depth)
+	})
+	assert.Equal(t, visited, []string{"a", "b", "d", "c"}, "should walk depth first")
+	assert.Equal(t, depths, []int{0, 1, 2, 1})
+}
+
+func TestAssembleIntegrity(t *testing.T) {
+	foreign := span("x", "a", 1, 2)
+	foreign.TraceId = "other"
+	trace := Assemble([]st.Span{
+		span("a", "", 0, 10),
+		span("b", "a", 1, 11),
+		span("b", "a", 1, 2),
+		span("orphan", "missing", 3, 4),
+		span("second-root", "", 20, 30),
+		span("loop1", "loop2", 5, 6),
+		span("loop2", "loop1", 5, 6),
+		span("self", "self", 7, 8),
+		foreign,
+	})
+	report := trace.Integrity
+	assert.False(t, report.Ok())
+	assert.True(t, report.MultipleRoots())
+	assert.Equal(t, report.Roots, []string{"a", "second-root"})
+	assert.Equal(t, report.Orphans, []string{"orphan"})
+	assert.Equal(t, report.DuplicateSpanIds, []string{"b"})
+	assert.Equal(t, report.OutsideParent, []string{"b"})
+	assert.Equal(t, report.ForeignSpans, []string{"x"})
+	assert.Equal(t, report.Cycles, [][]string{{"loop1", "loop2"}, {"self"}})
+
+	assert.Equal(t, spanIds(trace.Roots), []string{"a", "orphan", "loop1", "self", "second-root"}, "every span should be reachable")
+	_, ok := trace.Root()
+	assert.False(t, ok, "should not pick a root when there are several")
+
+	count := 0
+	trace.Walk(func(node *Node, depth int) {
+		count++
+	})
+	assert.Equal(t, count, len(trace.Nodes), "should visit every span once")
+}
+
+func TestAssembleEmpty(t *testing.T) {
+	trace := Assemble([]st.Span{})
+	assert.Empty(t, trace.Roots)
+	assert.False(t, trace.Integrity.Ok(), "an empty trace has no root")
+}
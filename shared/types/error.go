@@ -10,6 +10,8 @@ type Error struct {
 	Timestamp time.Time `json:"timestamp" cassandra:"timestamp"`
 	Component string    `json:"component" cassandra:"component"`
 	Event     string    `json:"event" cassandra:"event"`
+	// the message being handled when the error happened, if there was one
+	MessageId string `json:"message_id,omitempty" cassandra:"message_id,omitempty"`
 }
 
 type ErrorMessage struct {
@@ -0,0 +1,38 @@
+package shared
+
+import (
+	"time"
+)
+
+// export states for a trace at a single destination
+const (
+	STATUS_PENDING  = "pending"
+	STATUS_EXPORTED = "exported"
+	STATUS_FAILED   = "failed"
+)
+
+// ExportStatus tracks delivery of a trace to one destination. Spans that
+// show up after a trace has been exported are picked out using
+// ExportedSpanIds.
+type ExportStatus struct {
+	TraceId         string    `json:"trace_id" cassandra:"trace_id"`
+	Destination     string    `json:"destination" cassandra:"destination"`
+	Status          string    `json:"status" cassandra:"status"`
+	Attempts        int       `json:"attempts" cassandra:"attempts"`
+	LastError       string    `json:"last_error,omitempty" cassandra:"last_error"`
+	ExportedSpanIds []string  `json:"exported_span_ids,omitempty" cassandra:"exported_span_ids"`
+	CreatedAt       time.Time `json:"created_at" cassandra:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at" cassandra:"updated_at"`
+}
+
+func NewExportStatus(traceId string, destination string) *ExportStatus {
+	now := time.Now()
+	return &ExportStatus{
+		TraceId:         traceId,
+		Destination:     destination,
+		Status:          STATUS_PENDING,
+		ExportedSpanIds: make([]string, 0),
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+}
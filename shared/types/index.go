@@ -0,0 +1,70 @@
+package shared
+
+import (
+	"fmt"
+	"math"
+)
+
+// how long each lookup table partition covers, in milliseconds
+const HOUR_MS = 60 * 60 * 1000
+
+// SpanSummary is what the lookup tables keep about a span, enough to list it
+// in search results without loading its trace.
+type SpanSummary struct {
+	TraceId    string `json:"trace_id" cassandra:"trace_id"`
+	SpanId     string `json:"span_id" cassandra:"span_id"`
+	EntityName string `json:"entity_name" cassandra:"entity_name"`
+	Name       string `json:"name" cassandra:"name"`
+	// start time bucketed by hour, keeps partitions from growing forever
+	Hour      int64   `json:"-" cassandra:"hour"`
+	StartTime float64 `json:"start_time" cassandra:"start_time"`
+	Duration  float64 `json:"duration" cassandra:"duration"`
+}
+
+// TaggedSpanSummary is a span found by one of its tag values.
+type TaggedSpanSummary struct {
+	SpanSummary
+	Tag   string `json:"tag" cassandra:"tag"`
+	Value string `json:"value" cassandra:"value"`
+}
+
+// SpanName is a span name seen from an entity.
+type SpanName struct {
+	EntityName string `json:"entity_name" cassandra:"entity_name"`
+	Name       string `json:"name" cassandra:"name"`
+}
+
+// HourOf gives the hour bucket for a time in milliseconds.
+func HourOf(ms float64) int64 {
+	return int64(math.Floor(ms / HOUR_MS))
+}
+
+func NewSpanSummary(span Span, entityName string) SpanSummary {
+	return SpanSummary{
+		TraceId:    span.TraceId,
+		SpanId:     span.SpanId,
+		EntityName: entityName,
+		Name:       span.Name,
+		Hour:       HourOf(span.StartTime),
+		StartTime:  span.StartTime,
+		Duration:   span.FinishTime - span.StartTime,
+	}
+}
+
+// TagSummaries gives a summary for each of the tags the span has out of
+// indexedTags. Tag values are indexed as strings, e.g. 500 is "500".
+func TagSummaries(summary SpanSummary, tags map[string]interface{}, indexedTags []string) []TaggedSpanSummary {
+	tagged := make([]TaggedSpanSummary, 0)
+	for _, tag := range indexedTags {
+		v, ok := tags[tag]
+		if !ok || v == nil {
+			continue
+		}
+		tagged = append(tagged, TaggedSpanSummary{
+			SpanSummary: summary,
+			Tag:         tag,
+			Value:       fmt.Sprint(v),
+		})
+	}
+	return tagged
+}
@@ -0,0 +1,27 @@
+package shared
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpanSummary(t *testing.T) {
+	span := Span{TraceId: "t1", SpanId: "a", Name: "GET /", StartTime: 2*HOUR_MS + 100, FinishTime: 2*HOUR_MS + 350}
+	summary := NewSpanSummary(span, "checkout")
+	assert.Equal(t, summary.Hour, int64(2))
+	assert.Equal(t, summary.Duration, float64(250))
+	assert.Equal(t, summary.EntityName, "checkout")
+
+	tagged := TagSummaries(summary, map[string]interface{}{
+		"http.status_code": float64(500),
+		"error":            true,
+		"db.statement":     "select 1",
+		"missing":          nil,
+	}, []string{"http.status_code", "error", "missing", "customer"})
+	assert.Equal(t, len(tagged), 2, "should only index the configured tags the span has")
+	assert.Equal(t, tagged[0].Tag, "http.status_code")
+	assert.Equal(t, tagged[0].Value, "500", "should index numbers as they'd be written")
+	assert.Equal(t, tagged[1].Value, "true")
+	assert.Equal(t, tagged[1].TraceId, "t1")
+}
@@ -0,0 +1,21 @@
+package shared_test
+
+import (
+	"reflect"
+	"testing"
+	"testing/quick"
+
+	st "shared/types"
+	stt "shared/typestest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// an external test, since shared/typestest imports this package
+func TestSpanRecordRoundTrip(t *testing.T) {
+	roundTrip := func(rs stt.RandomSpan) bool {
+		s := st.Span(rs)
+		return reflect.DeepEqual(*st.RecordToSpan(*st.SpanToRecord(s)), s)
+	}
+	assert.Nil(t, quick.Check(roundTrip, nil), "spans should survive being stored")
+}
@@ -0,0 +1,40 @@
+package shared
+
+import (
+	"time"
+)
+
+// InterestingTrace is a row in span_collector.interesting_traces, there is
+// one for every reason a trace was selected.
+type InterestingTrace struct {
+	TraceId string `json:"trace_id" cassandra:"trace_id"`
+	// rule name, or where the selection came from (e.g. anomaly, manual)
+	Reason string `json:"reason" cassandra:"reason"`
+	// the span that triggered the selection, if there was one
+	SpanId     string    `json:"span_id,omitempty" cassandra:"span_id"`
+	EntityName string    `json:"entity_name,omitempty" cassandra:"entity_name"`
+	Score      float64   `json:"score,omitempty" cassandra:"score"`
+	SelectedAt time.Time `json:"selected_at" cassandra:"selected_at"`
+}
+
+func NewInterestingTrace(traceId string, reason string) *InterestingTrace {
+	return &InterestingTrace{
+		TraceId:    traceId,
+		Reason:     reason,
+		SelectedAt: time.Now(),
+	}
+}
+
+// TraceSelection lets the span processors know a trace has been stored as
+// interesting.
+type TraceSelection struct {
+	InterestingTrace
+	MessageId string `json:"message_id"`
+}
+
+func NewTraceSelection(trace InterestingTrace, messageId string) *TraceSelection {
+	return &TraceSelection{
+		InterestingTrace: trace,
+		MessageId:        messageId,
+	}
+}
@@ -1,8 +1,11 @@
 package shared
 
 import (
+	"encoding/json"
+	"log"
 	"reflect"
 	"strings"
+	"unicode/utf8"
 )
 
 type Span struct {
@@ -25,6 +28,17 @@ type SpanRecord struct {
 	StringTags  map[string]string  `json:"string_tags,omitempty" cassandra:"string_tags"`
 	BooleanTags map[string]bool    `json:"boolean_tags,omitempty" cassandra:"boolean_tags"`
 	NumberTags  map[string]float64 `json:"number_tags,omitempty" cassandra:"number_tags"`
+	// anything that isn't a string, bool or number (null, objects, arrays)
+	// is stored JSON encoded so it can be restored as is
+	JsonTags map[string]string `json:"json_tags,omitempty" cassandra:"json_tags"`
+}
+
+// SpanRow is a span as it is stored, along with who sent it.
+type SpanRow struct {
+	SpanRecord
+	EntityName string `json:"entity_name" cassandra:"entity_name"`
+	LicenseKey string `json:"license_key,omitempty" cassandra:"license_key,omitempty"`
+	EntityId   string `json:"entity_id,omitempty" cassandra:"entity_id,omitempty"`
 }
 
 type SpanMessage struct {
@@ -63,23 +77,25 @@ func SpanToRecord(s Span) *SpanRecord {
 	stringTags := make(map[string]string)
 	numberTags := make(map[string]float64)
 	boolTags := make(map[string]bool)
+	jsonTags := make(map[string]string)
 
 	for k, v := range s.Tags {
-		t := reflect.TypeOf(v).Name()
-		switch t {
-		case "string":
-			stringTags[k] = v.(string)
-			break
-		case "bool":
-			boolTags[k] = v.(bool)
-			break
-		case "float64":
-			numberTags[k] = v.(float64)
-			break
+		switch tag := v.(type) {
+		case string:
+			stringTags[k] = tag
+		case bool:
+			boolTags[k] = tag
+		case float64:
+			numberTags[k] = tag
+		case float32, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+			numberTags[k] = reflect.ValueOf(tag).Convert(reflect.TypeOf(float64(0))).Float()
 		default:
-			// TODO: log here?
-			break
-
+			encoded, err := json.Marshal(tag)
+			if err != nil {
+				log.Printf("dropping tag %s from span %s: %s", k, s.SpanId, err)
+				continue
+			}
+			jsonTags[k] = string(encoded)
 		}
 	}
 
@@ -93,6 +109,7 @@ func SpanToRecord(s Span) *SpanRecord {
 		StringTags:  stringTags,
 		BooleanTags: boolTags,
 		NumberTags:  numberTags,
+		JsonTags:    jsonTags,
 	}
 }
 
@@ -107,6 +124,18 @@ func RecordToSpan(sr SpanRecord) *Span {
 	for k, v := range sr.NumberTags {
 		tags[k] = v
 	}
+	for k, v := range sr.JsonTags {
+		var tag interface{}
+		if err := json.Unmarshal([]byte(v), &tag); err != nil {
+			log.Printf("dropping tag %s from span %s: %s", k, sr.SpanId, err)
+			continue
+		}
+		tags[k] = tag
+	}
+	// match what decoding a span without tags gives us
+	if len(tags) == 0 {
+		tags = nil
+	}
 	return &Span{
 		TraceId:    sr.TraceId,
 		SpanId:     sr.SpanId,
@@ -117,3 +146,39 @@ func RecordToSpan(sr SpanRecord) *Span {
 		Tags:       tags,
 	}
 }
+
+// the boolean tag set on spans that had tags cut short to be stored
+const TRUNCATED_TAG = "tags.truncated"
+
+// TruncateTags cuts string tags (e.g. huge db.statement tags) down to
+// maxBytes, flagging the span if anything was cut. It gives back whether
+// anything was cut.
+func (sr *SpanRecord) TruncateTags(maxBytes int) bool {
+	truncated := false
+	for k, v := range sr.StringTags {
+		if len(v) > maxBytes {
+			// back off to the start of a rune, cassandra won't store
+			// invalid UTF-8
+			cut := maxBytes
+			for cut > 0 && !utf8.RuneStart(v[cut]) {
+				cut--
+			}
+			sr.StringTags[k] = v[:cut]
+			truncated = true
+		}
+	}
+	for k, v := range sr.JsonTags {
+		if len(v) > maxBytes {
+			// cutting JSON short would make it unreadable
+			delete(sr.JsonTags, k)
+			truncated = true
+		}
+	}
+	if truncated {
+		if sr.BooleanTags == nil {
+			sr.BooleanTags = make(map[string]bool)
+		}
+		sr.BooleanTags[TRUNCATED_TAG] = true
+	}
+	return truncated
+}
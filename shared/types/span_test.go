@@ -0,0 +1,50 @@
+package shared
+
+import (
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpanToRecordNumbers(t *testing.T) {
+	record := SpanToRecord(Span{
+		SpanId: "a",
+		Tags: map[string]interface{}{
+			"int":   3,
+			"uint8": uint8(4),
+		},
+	})
+	assert.Equal(t, record.NumberTags, map[string]float64{
+		"int":   3,
+		"uint8": 4,
+	}, "go number types should be stored as numbers")
+}
+
+func TestTruncateTags(t *testing.T) {
+	record := SpanToRecord(Span{
+		SpanId: "a",
+		Tags: map[string]interface{}{
+			"db.statement": "select * from users",
+			"short":        "ok",
+			"nested":       map[string]interface{}{"a": "long enough to drop"},
+		},
+	})
+	assert.True(t, record.TruncateTags(6))
+	assert.Equal(t, record.StringTags, map[string]string{
+		"db.statement": "select",
+		"short":        "ok",
+	}, "should cut long strings")
+	assert.Empty(t, record.JsonTags, "should drop long json tags")
+	assert.True(t, record.BooleanTags[TRUNCATED_TAG], "should flag the span")
+
+	record = SpanToRecord(Span{SpanId: "b", Tags: map[string]interface{}{"short": "ok"}})
+	assert.False(t, record.TruncateTags(6))
+	assert.Empty(t, record.BooleanTags, "should only flag truncated spans")
+
+	// "é" is two bytes, the limit falls in the middle of the second one
+	record = SpanToRecord(Span{SpanId: "c", Tags: map[string]interface{}{"city": "aéé"}})
+	assert.True(t, record.TruncateTags(4))
+	assert.Equal(t, record.StringTags["city"], "aé", "should not split a character")
+	assert.True(t, utf8.ValidString(record.StringTags["city"]))
+}
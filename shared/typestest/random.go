@@ -0,0 +1,66 @@
+package shared
+
+import (
+	"math/rand"
+	"reflect"
+	"strconv"
+
+	st "shared/types"
+)
+
+// RandomSpan generates spans for property based tests (see testing/quick)
+// the way they show up off the wire: tags hold whatever JSON decoding gives
+// back, and times are epoch milliseconds. It's only meant to be imported by
+// tests.
+type RandomSpan st.Span
+
+func randomTag(r *rand.Rand, depth int) interface{} {
+	kinds := 6
+	if depth > 1 {
+		// stop nesting
+		kinds = 4
+	}
+	switch r.Intn(kinds) {
+	case 0:
+		return strconv.Itoa(r.Int())
+	case 1:
+		return r.Intn(2) == 0
+	case 2:
+		return r.NormFloat64() * 1e6
+	case 3:
+		return nil
+	case 4:
+		nested := make(map[string]interface{})
+		for i := r.Intn(3); i > 0; i-- {
+			nested[strconv.Itoa(i)] = randomTag(r, depth+1)
+		}
+		return nested
+	default:
+		list := make([]interface{}, r.Intn(3))
+		for i := range list {
+			list[i] = randomTag(r, depth+1)
+		}
+		return list
+	}
+}
+
+func (RandomSpan) Generate(r *rand.Rand, size int) reflect.Value {
+	startTime := 1.5e12 + r.Float64()*1e11
+	span := RandomSpan{
+		TraceId:    strconv.FormatUint(r.Uint64(), 16),
+		SpanId:     strconv.FormatUint(r.Uint64(), 16),
+		Name:       strconv.Itoa(r.Int()),
+		StartTime:  startTime,
+		FinishTime: startTime + r.ExpFloat64()*100,
+	}
+	if r.Intn(2) == 0 {
+		span.ParentId = strconv.FormatUint(r.Uint64(), 16)
+	}
+	if numTags := r.Intn(size + 1); numTags > 0 {
+		span.Tags = make(map[string]interface{})
+		for i := 0; i < numTags; i++ {
+			span.Tags[strconv.Itoa(i)] = randomTag(r, 0)
+		}
+	}
+	return reflect.ValueOf(span)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	stree "shared/trace"
+	st "shared/types"
+)
+
+// tag listing why the trace was kept
+var SELECTION_REASONS_TAG string = "selection.reasons"
+
+// selectionReasons gives the distinct reasons a trace was selected for,
+// sorted and comma separated.
+func selectionReasons(selections []st.InterestingTrace) string {
+	seen := make(map[string]bool)
+	reasons := make([]string, 0, len(selections))
+	for _, selection := range selections {
+		if !seen[selection.Reason] {
+			seen[selection.Reason] = true
+			reasons = append(reasons, selection.Reason)
+		}
+	}
+	sort.Strings(reasons)
+	return strings.Join(reasons, ",")
+}
+
+// annotateEvents tags every event with its span's self time and the reasons
+// the trace was selected, and marks the ones on the trace's critical path
+// along with how long they spent on it. Any clock skew correction made to the
+// trace is carried over too.
+func annotateEvents(trace *stree.Trace, selections []st.InterestingTrace, LicenseKeyToEvents map[string]SpanList) {
+	selfTimes := trace.SelfTimes()
+	criticalTimes := trace.CriticalTimes()
+	reasons := selectionReasons(selections)
+	for _, events := range LicenseKeyToEvents {
+		for i := range *events {
+			e := &(*events)[i]
+			if e.Tags == nil {
+				e.Tags = make(map[string]interface{})
+			}
+			if node, ok := trace.Nodes[e.SpanId]; ok {
+				if offset, ok := node.Span.Tags[stree.SKEW_OFFSET_TAG]; ok {
+					e.Timestamp = node.Span.StartTime
+					e.Tags[stree.SKEW_OFFSET_TAG] = offset
+				}
+			}
+			if reasons != "" {
+				e.Tags[SELECTION_REASONS_TAG] = reasons
+			}
+			if selfTime, ok := selfTimes[e.SpanId]; ok {
+				e.Tags["self_time.ms"] = selfTime
+			}
+			criticalTime, ok := criticalTimes[e.SpanId]
+			e.Tags["critical_path"] = ok
+			if ok {
+				e.Tags["critical_path.ms"] = criticalTime
+			}
+		}
+	}
+}
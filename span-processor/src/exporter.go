@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+type Exporter interface {
+	// Destination names where spans are sent, delivery is tracked per
+	// destination.
+	Destination() string
+	Send(licenseKey string, events SpanList) error
+}
+
+type NewRelicExporter struct {
+	Url    string
+	client *http.Client
+}
+
+func NewNewRelicExporter() *NewRelicExporter {
+	return &NewRelicExporter{
+		Url:    "https://staging-collector.newrelic.com/agent_listener/invoke_raw_method",
+		client: &http.Client{},
+	}
+}
+
+func (e *NewRelicExporter) Destination() string {
+	return "newrelic"
+}
+
+func (e *NewRelicExporter) Send(licenseKey string, events SpanList) error {
+	payload := map[string][]SpanEvent{"spans": *events}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	log.Printf("sending %d events for license key %s", len(*events), licenseKey)
+
+	req, err := http.NewRequest("POST", e.Url, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	// set query params and headers
+	q := req.URL.Query()
+	q.Add("protocol_version", "1")
+	q.Add("license_key", licenseKey)
+	q.Add("method", "external_span_data")
+	req.URL.RawQuery = q.Encode()
+
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 400 {
+		return fmt.Errorf("%s responded with %s", e.Destination(), res.Status)
+	}
+	return nil
+}
+
+func SendEvents(exporter Exporter, licenseKey string, events SpanList, resChan chan *RequestResult) {
+	resChan <- &RequestResult{
+		Err:        exporter.Send(licenseKey, events),
+		LicenseKey: licenseKey,
+		Events:     events,
+	}
+}
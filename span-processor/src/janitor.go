@@ -0,0 +1,165 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	sc "shared/config"
+	sdb "shared/db"
+	st "shared/types"
+)
+
+// RetryPolicy is how often exports that failed, or never finished, are tried
+// again.
+type RetryPolicy struct {
+	// how long to wait after the first attempt, doubling after each one
+	Backoff time.Duration
+	// zero keeps trying forever
+	MaxAttempts int
+}
+
+func NewRetryPolicyFromEnv() RetryPolicy {
+	return RetryPolicy{
+		Backoff:     sc.Duration("EXPORT_RETRY_BACKOFF", time.Minute),
+		MaxAttempts: sc.Int("EXPORT_MAX_ATTEMPTS", 5),
+	}
+}
+
+// delay is how long to wait after the given number of attempts before trying
+// again.
+func (p RetryPolicy) delay(attempts int) time.Duration {
+	if attempts < 1 {
+		return 0
+	}
+	if attempts > 30 {
+		attempts = 30
+	}
+	return p.Backoff * time.Duration(1<<uint(attempts-1))
+}
+
+func (p RetryPolicy) exhausted(attempts int) bool {
+	return p.MaxAttempts > 0 && attempts >= p.MaxAttempts
+}
+
+// Janitor periodically archives traces out of the interesting set once
+// everything in them has been exported, so the set doesn't grow forever but
+// the reasons they were kept are still around. Traces that
+// haven't made it everywhere are handed back to be exported again until they
+// run out of attempts.
+type Janitor struct {
+	store     sdb.TraceSelectionStore
+	exporters []Exporter
+	grace     time.Duration
+	interval  time.Duration
+	retry     RetryPolicy
+	retention *sdb.RetentionPolicy
+	enqueue   func(job ExportJob)
+}
+
+func NewJanitor(store sdb.TraceSelectionStore, exporters []Exporter, grace time.Duration, interval time.Duration, retry RetryPolicy, retention *sdb.RetentionPolicy, enqueue func(job ExportJob)) *Janitor {
+	return &Janitor{
+		store:     store,
+		exporters: exporters,
+		grace:     grace,
+		interval:  interval,
+		retry:     retry,
+		retention: retention,
+		enqueue:   enqueue,
+	}
+}
+
+func (j *Janitor) Start() {
+	for {
+		time.Sleep(j.interval)
+		removed, err := j.Sweep(time.Now())
+		if err != nil {
+			log.Print("janitor error: ", err)
+		}
+		if removed > 0 {
+			log.Printf("janitor archived %d exported traces", removed)
+		}
+	}
+}
+
+// Sweep looks at interesting traces that were selected more than the grace
+// period ago. Ones that have been exported to every destination are archived,
+// ones that are due another attempt are enqueued, and ones that are out of
+// attempts are given up on and archived.
+func (j *Janitor) Sweep(now time.Time) (int, error) {
+	selections, err := j.store.Selections()
+	if err != nil {
+		return 0, err
+	}
+	// a trace has a row per reason it was selected, go by the latest
+	lastSelected := make(map[string]time.Time)
+	entityNames := make(map[string][]string)
+	for _, selection := range selections {
+		if last, ok := lastSelected[selection.TraceId]; !ok || selection.SelectedAt.After(last) {
+			lastSelected[selection.TraceId] = selection.SelectedAt
+		}
+		entityNames[selection.TraceId] = append(entityNames[selection.TraceId], selection.EntityName)
+	}
+
+	removed := 0
+	for traceId, selectedAt := range lastSelected {
+		// the processor may still be waiting on this trace to complete
+		if now.Sub(selectedAt) < j.grace {
+			continue
+		}
+		done, retry, err := j.check(traceId, now.Sub(selectedAt)-j.grace, now)
+		if err != nil {
+			return removed, err
+		}
+		if retry {
+			j.enqueue(ExportJob{TraceId: traceId, Sweep: true})
+			continue
+		}
+		if !done {
+			continue
+		}
+		if err := j.store.ArchiveTrace(traceId, j.retention.MaxTTL(entityNames[traceId]...)); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// check works out whether a trace is done with, either exported everywhere
+// or out of attempts, and if not whether it is due another attempt. Waited
+// is how long the trace has been past the grace period.
+func (j *Janitor) check(traceId string, waited time.Duration, now time.Time) (bool, bool, error) {
+	statuses, err := j.store.ExportStatuses(traceId)
+	if err != nil {
+		return false, false, err
+	}
+	byDestination := make(map[string]*st.ExportStatus)
+	for i := range statuses {
+		byDestination[statuses[i].Destination] = &statuses[i]
+	}
+	done := true
+	retry := false
+	for _, exporter := range j.exporters {
+		status, ok := byDestination[exporter.Destination()]
+		switch {
+		case ok && status.Status == st.STATUS_EXPORTED:
+		case !ok:
+			// never attempted, e.g. the processor restarted while waiting
+			// on the trace to complete
+			if j.retry.MaxAttempts > 0 && waited > j.retry.delay(j.retry.MaxAttempts) {
+				log.Printf("giving up on exporting trace %s to %s, it was never attempted", traceId, exporter.Destination())
+				continue
+			}
+			done = false
+			retry = true
+		case j.retry.exhausted(status.Attempts):
+			log.Printf("giving up on exporting trace %s to %s after %d attempts", traceId, exporter.Destination(), status.Attempts)
+		default:
+			done = false
+			if now.Sub(status.UpdatedAt) >= j.retry.delay(status.Attempts) {
+				retry = true
+			}
+		}
+	}
+	return done, retry, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	sdb "shared/db"
+	st "shared/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJanitorSweep(t *testing.T) {
+	now := time.Now()
+	store := sdb.NewMemoryStore()
+	selection := func(traceId string, reason string, ago time.Duration) *st.InterestingTrace {
+		trace := st.NewInterestingTrace(traceId, reason)
+		trace.SelectedAt = now.Add(-ago)
+		return trace
+	}
+	store.SaveSelections([]*st.InterestingTrace{
+		selection("done", "error", time.Hour),
+		selection("recent", "error", time.Hour),
+		selection("recent", "manual", time.Second),
+		selection("failed", "error", time.Hour),
+	}, 60)
+	for traceId, status := range map[string]string{
+		"done":   st.STATUS_EXPORTED,
+		"recent": st.STATUS_EXPORTED,
+		"failed": st.STATUS_FAILED,
+	} {
+		s := st.NewExportStatus(traceId, "test")
+		s.Status = status
+		s.UpdatedAt = now.Add(-time.Hour)
+		store.SaveExportStatus(s, 60)
+	}
+
+	retried := make([]ExportJob, 0)
+	janitor := NewJanitor(store, []Exporter{newTestExporter()}, time.Minute, time.Minute, RetryPolicy{Backoff: time.Minute, MaxAttempts: 3}, &sdb.RetentionPolicy{}, func(job ExportJob) {
+		retried = append(retried, job)
+	})
+	removed, err := janitor.Sweep(now)
+	assert.Nil(t, err)
+	assert.Equal(t, removed, 1)
+
+	left := make([]string, 0)
+	selections, _ := store.Selections()
+	for _, s := range selections {
+		left = append(left, s.TraceId+"/"+s.Reason)
+	}
+	assert.ElementsMatch(t, left, []string{
+		"recent/error",
+		"recent/manual",
+		"failed/error",
+	}, "should keep recently selected and unexported traces")
+	reasons, _ := store.TraceSelections("done")
+	assert.Equal(t, len(reasons), 1, "should archive the reasons of exported traces")
+	assert.Equal(t, retried, []ExportJob{{TraceId: "failed", Sweep: true}}, "should try failed exports again")
+}
+
+func TestJanitorRetries(t *testing.T) {
+	now := time.Now()
+	store := sdb.NewMemoryStore()
+	for _, traceId := range []string{"due", "waiting", "exhausted", "pending", "unattempted", "forgotten"} {
+		trace := st.NewInterestingTrace(traceId, "error")
+		trace.SelectedAt = now.Add(-time.Hour)
+		if traceId == "unattempted" {
+			trace.SelectedAt = now.Add(-2 * time.Minute)
+		}
+		store.SaveSelections([]*st.InterestingTrace{trace}, 60)
+	}
+	for traceId, attempts := range map[string]int{"due": 2, "waiting": 2, "exhausted": 3, "pending": 1} {
+		s := st.NewExportStatus(traceId, "test")
+		s.Status = st.STATUS_FAILED
+		s.Attempts = attempts
+		// the second attempt waits two minutes
+		s.UpdatedAt = now.Add(-3 * time.Minute)
+		if traceId == "waiting" {
+			s.UpdatedAt = now.Add(-time.Minute)
+		}
+		if traceId == "pending" {
+			// the processor stopped part way through
+			s.Status = st.STATUS_PENDING
+		}
+		store.SaveExportStatus(s, 60)
+	}
+
+	retried := make([]string, 0)
+	janitor := NewJanitor(store, []Exporter{newTestExporter()}, time.Minute, time.Minute, RetryPolicy{Backoff: time.Minute, MaxAttempts: 3}, &sdb.RetentionPolicy{}, func(job ExportJob) {
+		retried = append(retried, job.TraceId)
+	})
+	removed, err := janitor.Sweep(now)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, retried, []string{"due", "pending", "unattempted"})
+	assert.Equal(t, removed, 2, "should give up on traces out of attempts")
+
+	left := make([]string, 0)
+	selections, _ := store.Selections()
+	for _, s := range selections {
+		left = append(left, s.TraceId)
+	}
+	assert.ElementsMatch(t, left, []string{"due", "waiting", "pending", "unattempted"})
+}
@@ -1,181 +1,277 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"log"
-	"net/http"
-	"strings"
 	"time"
 
+	sc "shared/config"
 	sdb "shared/db"
+	sm "shared/message"
+	stree "shared/trace"
 	st "shared/types"
-
-	"github.com/gocql/gocql"
 )
 
-func SendEvents(licenseKey string, events SpanList, resChan chan *RequestResult) {
-	payload := map[string][]SpanEvent{"spans": *events}
-	body, err := json.Marshal(payload)
-	response := new(RequestResult)
-	response.Events = events
-	response.LicenseKey = licenseKey
+// how long to wait after exporting a trace before picking up any spans that
+// arrived late
+var SWEEP_DELAY time.Duration = 30 * time.Second
+
+type ExportJob struct {
+	TraceId   string
+	MessageId string
+	Sweep     bool
+}
+
+// populateEventMap buckets a trace's spans by license key. Spans that came in
+// without one go to the default license key, or are skipped if there isn't
+// one.
+func populateEventMap(store sdb.SpanStore, traceId string, defaultLicenseKey string, LicenseKeyToEvents map[string]SpanList) {
+	rows, err := store.TraceSpans(traceId)
 	if err != nil {
-		response.Err = err
-		resChan <- response
+		log.Print(err)
+	}
+	for _, row := range rows {
+		licenseKey := row.LicenseKey
+		if licenseKey == "" {
+			if defaultLicenseKey == "" {
+				log.Printf("skipping span %s of trace %s, it has no license key", row.SpanId, traceId)
+				continue
+			}
+			licenseKey = defaultLicenseKey
+		}
+		eventBucketPtr, ok := LicenseKeyToEvents[licenseKey]
+		if !ok {
+			eventBucketPtr = new([]SpanEvent)
+			LicenseKeyToEvents[licenseKey] = eventBucketPtr
+		}
+		span := st.RecordToSpan(row.SpanRecord)
+		spanEvent := SpanToEvent(*span, row.EntityName, row.EntityId)
+		*eventBucketPtr = append(*eventBucketPtr, spanEvent)
+	}
+}
+
+// unexportedEvents filters out events that have already made it to the
+// destination.
+func unexportedEvents(LicenseKeyToEvents map[string]SpanList, status *st.ExportStatus) map[string]SpanList {
+	exported := make(map[string]bool)
+	for _, spanId := range status.ExportedSpanIds {
+		exported[spanId] = true
+	}
+	pending := make(map[string]SpanList)
+	for licenseKey, events := range LicenseKeyToEvents {
+		for _, e := range *events {
+			if exported[e.SpanId] {
+				continue
+			}
+			eventBucketPtr, ok := pending[licenseKey]
+			if !ok {
+				eventBucketPtr = new([]SpanEvent)
+				pending[licenseKey] = eventBucketPtr
+			}
+			*eventBucketPtr = append(*eventBucketPtr, e)
+		}
+	}
+	return pending
+}
+
+// exportTrace sends the spans of a trace to every destination that hasn't
+// received them yet, and records how it went.
+func exportTrace(spanStore sdb.SpanStore, selections sdb.TraceSelectionStore, job ExportJob, exporters []Exporter, defaultLicenseKey string, retention *sdb.RetentionPolicy, errHandler sm.ErrorReporter) {
+	// used to break events out into payloads to send
+	LicenseKeyToEvents := make(map[string]SpanList)
+	populateEventMap(spanStore, job.TraceId, defaultLicenseKey, LicenseKeyToEvents)
+
+	if len(LicenseKeyToEvents) == 0 {
+		if !job.Sweep {
+			log.Printf("no spans found for trace %s", job.TraceId)
+		}
 		return
 	}
-	log.Printf("sending %d events for license key %s", len(*events), licenseKey)
 
-	req, err := http.NewRequest("POST", "https://staging-collector.newrelic.com/agent_listener/invoke_raw_method", bytes.NewBuffer(body))
+	spans := make([]st.Span, 0)
+	spanEntities := make(map[string]string)
+	for _, events := range LicenseKeyToEvents {
+		for _, e := range *events {
+			spans = append(spans, EventToSpan(e))
+			spanEntities[e.SpanId] = e.EntityName
+		}
+	}
+	trace := stree.Assemble(spans)
+	if !trace.Integrity.Ok() {
+		log.Printf("trace %s does not fit together: %+v", job.TraceId, *trace.Integrity)
+	}
+	trace.AdjustSkew(func(spanId string) string {
+		return spanEntities[spanId]
+	})
+	// exported spans say why the trace was kept
+	reasons, err := selections.TraceSelections(job.TraceId)
 	if err != nil {
-		response.Err = err
-		resChan <- response
-		return
+		log.Print(err)
+		errHandler.HandleErr(&job.MessageId, err, "selections")
 	}
-	// set query params and headers
-	q := req.URL.Query()
-	q.Add("protocol_version", "1")
-	q.Add("license_key", licenseKey)
-	q.Add("method", "external_span_data")
-	req.URL.RawQuery = q.Encode()
+	annotateEvents(trace, reasons, LicenseKeyToEvents)
 
-	req.Header.Set("Content-Type", "application/json")
+	for _, exporter := range exporters {
+		status, err := selections.ExportStatus(job.TraceId, exporter.Destination())
+		if err != nil {
+			log.Print(err)
+			errHandler.HandleErr(&job.MessageId, err, "status")
+			continue
+		}
 
-	client := &http.Client{}
-	res, err := client.Do(req)
-	defer res.Body.Close()
+		// only process if there are events to send
+		pending := unexportedEvents(LicenseKeyToEvents, status)
+		if len(pending) == 0 {
+			continue
+		}
 
-	// TODO: parse response and propagate it to the main goroutine
-	resChan <- response
-}
+		// the status covers the whole trace, so it's kept as long as any of
+		// its entities' spans are
+		entityNames := make([]string, 0)
+		seen := make(map[string]bool)
+		for _, events := range pending {
+			for _, e := range *events {
+				if !seen[e.EntityName] {
+					seen[e.EntityName] = true
+					entityNames = append(entityNames, e.EntityName)
+				}
+			}
+		}
+		ttl := retention.MaxTTL(entityNames...)
 
-func getInterestingTraces(session *gocql.Session) []string {
-	// TODO: cache this and update it later so it isn't hammering the db
-	iter := session.Query("SELECT trace_id FROM span_collector.interesting_traces").Iter()
-	interestingTraces := make([]string, 0)
-	for {
-		result := make(map[string]interface{})
-		if !iter.MapScan(result) {
-			break
+		status.Status = st.STATUS_PENDING
+		status.Attempts++
+		status.UpdatedAt = time.Now()
+		if err := selections.SaveExportStatus(status, ttl); err != nil {
+			log.Print(err)
+			errHandler.HandleErr(&job.MessageId, err, "status")
 		}
-		interestingTraces = append(interestingTraces, result["trace_id"].(string))
-	}
-	return interestingTraces
-}
 
-func populateEventMap(session *gocql.Session, interestingTraces *[]string, LicenseKeyToEvents *map[string]SpanList) {
-	iter := session.Query("SELECT * FROM span_collector.spans WHERE trace_id IN ? AND sent = false", *interestingTraces).Iter()
-	for {
-		result := make(map[string]interface{})
-		if !iter.MapScan(result) {
-			break
+		numRequestsAwaiting := len(pending)
+		log.Printf("events found for trace %s, sending %d requests to %s", job.TraceId, numRequestsAwaiting, exporter.Destination())
+		resChan := make(chan *RequestResult)
+		// loop through the events bucketed by license key and kick the request off in parallel
+		for licenseKey, events := range pending {
+			go SendEvents(exporter, licenseKey, events, resChan)
 		}
-		licenseKey := result["license_key"].(string)
-		eventBucketPtr, ok := (*LicenseKeyToEvents)[licenseKey]
-		if !ok {
-			eventBucketPtr = new([]SpanEvent)
-			(*LicenseKeyToEvents)[licenseKey] = eventBucketPtr
+
+		status.Status = st.STATUS_EXPORTED
+		status.LastError = ""
+		// read off the return channel till all requests have come back
+		for ; numRequestsAwaiting != 0; numRequestsAwaiting-- {
+			result := <-resChan
+			// if there was an error, don't mark the events as exported,
+			// and let the sweep or the janitor pick them up.
+
+			// TODO: extra error handling here? are there cases where we want to throw the events away anyway?
+			if result.Err != nil {
+				log.Print(result.Err)
+				errHandler.HandleErr(&job.MessageId, result.Err, "send")
+				status.Status = st.STATUS_FAILED
+				status.LastError = result.Err.Error()
+				continue
+			}
+			for _, e := range *result.Events {
+				status.ExportedSpanIds = append(status.ExportedSpanIds, e.SpanId)
+			}
 		}
-		err, recordInterface := sdb.ParseRow(st.SpanRecord{}, result)
-		if err != nil {
-			log.Print("uh oh", err)
+
+		status.UpdatedAt = time.Now()
+		if err := selections.SaveExportStatus(status, ttl); err != nil {
+			log.Print(err)
+			errHandler.HandleErr(&job.MessageId, err, "status")
 		}
-		span := st.RecordToSpan(recordInterface.(st.SpanRecord))
-		spanEvent := SpanToEvent(*span, result["entity_name"].(string), result["entity_id"].(string))
-		*eventBucketPtr = append(*eventBucketPtr, spanEvent)
 	}
-
 }
 
 func main() {
-	cluster := gocql.NewCluster("cassandra")
-	cluster.Consistency = gocql.One
-	cluster.Keyspace = "span_collector"
-	session, err := cluster.CreateSession()
-
+	openStore, err := sdb.BackendFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	store, err := openStore()
 	for err != nil {
-		log.Print("ran into an error while setting up cassandra, waiting 5 seconds: ", err)
+		log.Print("ran into an error while opening the store, waiting 5 seconds: ", err)
 		time.Sleep(5 * time.Second)
-		session, err = cluster.CreateSession()
+		store, err = openStore()
 	}
+	defer store.Close()
 
-	// used to break events out into payloads to send
-	LicenseKeyToEvents := make(map[string]SpanList)
+	exporters := []Exporter{
+		NewNewRelicExporter(),
+	}
 
-	placeholderValues := []string{"?"}
-	for {
-		interestingTraces := getInterestingTraces(session)
+	errHandler := sm.NewErrorHandler("span-processor")
+	retention := sdb.NewRetentionPolicyFromEnv()
+	defaultLicenseKey := sc.String("DEFAULT_LICENSE_KEY", "")
 
-		if len(interestingTraces) == 0 {
-			log.Print("no interesting traces found, sleeping for 10 seconds")
-			time.Sleep(10 * time.Second)
-			continue
+	tracker := NewCompletionTracker(
+		sc.Duration("TRACE_QUIET_PERIOD", 10*time.Second),
+		sc.Duration("TRACE_COMPLETION_TIMEOUT", 2*time.Minute),
+	)
+
+	// watch spans come in so we know when selected traces are done
+	spanReader := sm.NewSpanMessageConsumer("span-processors")
+	msgChan := make(chan st.SpanMessage)
+	spanReader.Start(msgChan)
+	go func() {
+		for msg := range msgChan {
+			now := time.Now()
+			for _, s := range msg.Spans {
+				tracker.Observe(s, now)
+			}
 		}
+		log.Fatal("kafka message channel closed unexpectedly!")
+	}()
 
-		// collect unsent spans belonging to selected traces
-		populateEventMap(session, &interestingTraces, &LicenseKeyToEvents)
+	selectionReader := sm.NewTraceSelectionConsumer("span-processors")
+	selectionChan := make(chan st.TraceSelection)
+	selectionReader.Start(selectionChan)
+	go func() {
+		for selection := range selectionChan {
+			tracker.Select(ExportJob{
+				TraceId:   selection.TraceId,
+				MessageId: selection.MessageId,
+			}, time.Now())
+		}
+		log.Fatal("kafka selection channel closed unexpectedly!")
+	}()
 
-		// only process if there are events to send
-		if len(LicenseKeyToEvents) > 0 {
-			numRequestsAwaiting := len(LicenseKeyToEvents)
-			log.Printf("events found, sending %s requests", numRequestsAwaiting)
-			resChan := make(chan *RequestResult)
-			// loop through the events bucketed by license key and kick the request off in parallel
-			for licenseKey, events := range LicenseKeyToEvents {
-				go SendEvents(licenseKey, events, resChan)
-				delete(LicenseKeyToEvents, licenseKey)
-				// record the number of outstanding requests
-			}
+	jobs := make(chan ExportJob)
 
-			batch := gocql.NewBatch(gocql.LoggedBatch)
-
-			// read off the return channel till all requests have come back
-			for ; numRequestsAwaiting != 0; numRequestsAwaiting-- {
-				result := <-resChan
-				// if there was an error, don't remove the events from
-				// the queue, and let next pass pick them up.
-
-				// TODO: extra error handling here? are there cases where we want to throw the events away anyway?
-				if result.Err == nil {
-					spanEvents := *result.Events
-					for _, s := range spanEvents {
-						batch.Query(
-							"DELETE FROM span_collector.spans WHERE trace_id = ? AND sent = false AND span_id = ?;",
-							s.TraceId,
-							s.SpanId,
-						)
-						// TODO: event to record
-						fields, spanValues := sdb.GetKeysAndValues(*st.SpanToRecord(EventToSpan(s)))
-						*fields = append(*fields, "entity_name", "license_key", "entity_id")
-						*spanValues = append(*spanValues, s.EntityName, result.LicenseKey, s.EntityId)
-						batch.Query(
-							"INSERT INTO span_collector.spans (sent, "+strings.Join(*fields, ",")+") VALUES (true, "+sdb.MakePlaceholderString(&placeholderValues, len(*fields))+");",
-							*spanValues...,
-						)
-					}
-					if batch.Size() >= 10 {
-						err := session.ExecuteBatch(batch)
-						if err != nil {
-							log.Print(err)
-							//TODO: errHandler.handleErr(&msg.MessageId, &err)
-						}
-						batch = gocql.NewBatch(gocql.LoggedBatch)
-					}
-				}
-			}
+	// once a trace has been exported and swept, it no longer needs to be in
+	// the interesting set and is archived, and traces that didn't make it get tried again
+	janitor := NewJanitor(
+		store,
+		exporters,
+		tracker.Timeout+SWEEP_DELAY,
+		sc.Duration("JANITOR_INTERVAL", 5*time.Minute),
+		NewRetryPolicyFromEnv(),
+		retention,
+		func(job ExportJob) {
+			jobs <- job
+		},
+	)
+	go janitor.Start()
 
-			err := session.ExecuteBatch(batch)
-			if err != nil {
-				log.Print(err)
-				//TODO: errHandler.handleErr(&msg.MessageId, &err)
+	go func() {
+		for {
+			time.Sleep(time.Second)
+			for _, job := range tracker.Complete(time.Now()) {
+				jobs <- job
 			}
+		}
+	}()
 
-			log.Print("waiting 10 seconds to send again")
-			time.Sleep(10 * time.Second)
-		} else {
-			log.Print("no input found, waiting 3 seconds to check again")
-			time.Sleep(3 * time.Second)
+	for job := range jobs {
+		exportTrace(store, store, job, exporters, defaultLicenseKey, retention, errHandler)
+		if !job.Sweep {
+			// spans can still trickle in after the trace looked complete,
+			// so come back once more to pick up the stragglers
+			sweep := job
+			sweep.Sweep = true
+			time.AfterFunc(SWEEP_DELAY, func() {
+				jobs <- sweep
+			})
 		}
-	} // END FOR
+	}
 }
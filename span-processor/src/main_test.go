@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	sdb "shared/db"
+	st "shared/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testExporter struct {
+	lock sync.Mutex
+	fail bool
+	// license key -> span ids sent
+	sent map[string][]string
+	// span id -> tags sent
+	tags map[string]map[string]interface{}
+}
+
+func newTestExporter() *testExporter {
+	return &testExporter{
+		sent: make(map[string][]string),
+		tags: make(map[string]map[string]interface{}),
+	}
+}
+
+func (e *testExporter) Destination() string {
+	return "test"
+}
+
+func (e *testExporter) Send(licenseKey string, events SpanList) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.fail {
+		return errors.New("destination is down")
+	}
+	for _, event := range *events {
+		e.sent[licenseKey] = append(e.sent[licenseKey], event.SpanId)
+		e.tags[event.SpanId] = event.Tags
+	}
+	sort.Strings(e.sent[licenseKey])
+	return nil
+}
+
+type testErrorReporter struct {
+	events []string
+}
+
+func (r *testErrorReporter) HandleErr(messageId *string, err error, event string) {
+	r.events = append(r.events, event)
+}
+
+func storeSpans(store *sdb.MemoryStore, licenseKey string, spans ...st.Span) {
+	storeEntitySpans(store, "e", licenseKey, spans...)
+}
+
+func storeEntitySpans(store *sdb.MemoryStore, entityName string, licenseKey string, spans ...st.Span) {
+	rows := make([]st.SpanRow, len(spans))
+	for i, span := range spans {
+		rows[i] = st.SpanRow{SpanRecord: *st.SpanToRecord(span), EntityName: entityName, LicenseKey: licenseKey}
+	}
+	store.WriteSpans(rows, 60)
+}
+
+func TestExportTrace(t *testing.T) {
+	store := sdb.NewMemoryStore()
+	storeSpans(store, "key1",
+		st.Span{TraceId: "t1", SpanId: "a", StartTime: 0, FinishTime: 10},
+		st.Span{TraceId: "t1", SpanId: "b", ParentId: "a", StartTime: 1, FinishTime: 5},
+	)
+	storeSpans(store, "key2", st.Span{TraceId: "t1", SpanId: "c", ParentId: "a", StartTime: 2, FinishTime: 4})
+	storeSpans(store, "", st.Span{TraceId: "t1", SpanId: "d", ParentId: "a", StartTime: 2, FinishTime: 4})
+
+	selections := []*st.InterestingTrace{
+		st.NewInterestingTrace("t1", "latency"),
+		st.NewInterestingTrace("t1", "error"),
+	}
+	store.SaveSelections(selections, 60)
+
+	exporter := newTestExporter()
+	reporter := &testErrorReporter{}
+	job := ExportJob{TraceId: "t1", MessageId: "m1"}
+	exportTrace(store, store, job, []Exporter{exporter}, "", &sdb.RetentionPolicy{}, reporter)
+
+	assert.Equal(t, exporter.sent, map[string][]string{
+		"key1": {"a", "b"},
+		"key2": {"c"},
+	}, "should send spans per license key, skipping ones without one")
+	status, _ := store.ExportStatus("t1", "test")
+	assert.Equal(t, status.Status, st.STATUS_EXPORTED)
+	assert.Equal(t, status.Attempts, 1)
+	assert.ElementsMatch(t, status.ExportedSpanIds, []string{"a", "b", "c"})
+	assert.Equal(t, exporter.tags["b"][SELECTION_REASONS_TAG], "error,latency", "should say why the trace was kept")
+
+	// a late span is all that goes out on the sweep
+	storeSpans(store, "key1", st.Span{TraceId: "t1", SpanId: "e", ParentId: "a", StartTime: 6, FinishTime: 7})
+	exporter.sent = make(map[string][]string)
+	job.Sweep = true
+	exportTrace(store, store, job, []Exporter{exporter}, "", &sdb.RetentionPolicy{}, reporter)
+	assert.Equal(t, exporter.sent, map[string][]string{"key1": {"e"}})
+	assert.Empty(t, reporter.events)
+}
+
+func TestExportTraceFailure(t *testing.T) {
+	store := sdb.NewMemoryStore()
+	storeSpans(store, "key1", st.Span{TraceId: "t1", SpanId: "a", StartTime: 0, FinishTime: 10})
+
+	exporter := newTestExporter()
+	exporter.fail = true
+	reporter := &testErrorReporter{}
+	exportTrace(store, store, ExportJob{TraceId: "t1"}, []Exporter{exporter}, "", &sdb.RetentionPolicy{}, reporter)
+
+	status, _ := store.ExportStatus("t1", "test")
+	assert.Equal(t, status.Status, st.STATUS_FAILED)
+	assert.Equal(t, status.LastError, "destination is down")
+	assert.Empty(t, status.ExportedSpanIds)
+	assert.Equal(t, reporter.events, []string{"send"})
+}
+
+// ttlStore remembers the TTLs export statuses are saved with.
+type ttlStore struct {
+	*sdb.MemoryStore
+	ttls []int
+}
+
+func (s *ttlStore) SaveExportStatus(status *st.ExportStatus, ttl int) error {
+	s.ttls = append(s.ttls, ttl)
+	return s.MemoryStore.SaveExportStatus(status, ttl)
+}
+
+func TestExportTraceRetention(t *testing.T) {
+	store := sdb.NewMemoryStore()
+	storeEntitySpans(store, "search", "key1", st.Span{TraceId: "t1", SpanId: "a", StartTime: 0, FinishTime: 10})
+	storeEntitySpans(store, "checkout", "key1", st.Span{TraceId: "t1", SpanId: "b", ParentId: "a", StartTime: 1, FinishTime: 5})
+	retention := &sdb.RetentionPolicy{
+		Default: time.Hour,
+		Entities: map[string]time.Duration{
+			"search":   time.Minute,
+			"checkout": 2 * time.Hour,
+		},
+	}
+	statuses := &ttlStore{MemoryStore: store}
+	exportTrace(store, statuses, ExportJob{TraceId: "t1"}, []Exporter{newTestExporter()}, "", retention, &testErrorReporter{})
+	assert.Equal(t, statuses.ttls, []int{7200, 7200}, "should keep the status as long as the longest lived entity")
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	st "shared/types"
+)
+
+type traceState struct {
+	firstSeen time.Time
+	lastSeen  time.Time
+	hasRoot   bool
+	job       *ExportJob
+}
+
+// CompletionTracker watches spans as they come in so selected traces are only
+// exported once they look done: the root span has shown up and nothing new
+// has arrived for QuietPeriod, or Timeout has passed since the trace was
+// first seen.
+type CompletionTracker struct {
+	QuietPeriod time.Duration
+	Timeout     time.Duration
+	lock        sync.Mutex
+	traces      map[string]*traceState
+}
+
+func NewCompletionTracker(quietPeriod time.Duration, timeout time.Duration) *CompletionTracker {
+	return &CompletionTracker{
+		QuietPeriod: quietPeriod,
+		Timeout:     timeout,
+		traces:      make(map[string]*traceState),
+	}
+}
+
+func (t *CompletionTracker) getState(traceId string, now time.Time) *traceState {
+	state, ok := t.traces[traceId]
+	if !ok {
+		state = &traceState{
+			firstSeen: now,
+			lastSeen:  now,
+		}
+		t.traces[traceId] = state
+	}
+	return state
+}
+
+// Observe records the arrival of a span.
+func (t *CompletionTracker) Observe(s st.Span, now time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	state := t.getState(s.TraceId, now)
+	state.lastSeen = now
+	if s.ParentId == "" {
+		state.hasRoot = true
+	}
+}
+
+// Select marks a trace as wanted, it will be handed back from Complete once
+// it is done.
+func (t *CompletionTracker) Select(job ExportJob, now time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	state := t.getState(job.TraceId, now)
+	if state.job == nil {
+		state.job = &job
+	}
+}
+
+// Complete returns the export jobs for every selected trace that is done,
+// and forgets about them. Traces that were never selected are dropped once
+// they have been quiet for longer than the timeout.
+func (t *CompletionTracker) Complete(now time.Time) []ExportJob {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	jobs := make([]ExportJob, 0)
+	for traceId, state := range t.traces {
+		if state.job == nil {
+			if now.Sub(state.lastSeen) > t.Timeout {
+				delete(t.traces, traceId)
+			}
+			continue
+		}
+		quiet := now.Sub(state.lastSeen) >= t.QuietPeriod
+		timedOut := now.Sub(state.firstSeen) >= t.Timeout
+		if (state.hasRoot && quiet) || timedOut {
+			jobs = append(jobs, *state.job)
+			delete(t.traces, traceId)
+		}
+	}
+	return jobs
+}
@@ -9,7 +9,7 @@ type SpanEvent struct {
 	SpanId     string                 `json:"guid"`
 	ParentId   string                 `json:"parentId"`
 	Name       string                 `json:"name"`
-	Timestamp  uint64                 `json:"timestamp"`
+	Timestamp  float64                `json:"timestamp"`
 	Duration   float64                `json:"durationMs"`
 	Tags       map[string]interface{} `json:"tags,omitempty"`
 	EntityName string                 `json:"entityName"`
@@ -24,19 +24,23 @@ func EventToSpan(ev SpanEvent) st.Span {
 		SpanId:     ev.SpanId,
 		ParentId:   ev.ParentId,
 		Name:       ev.Name,
-		StartTime:  float64(ev.Timestamp),
-		FinishTime: ev.Duration - float64(ev.Timestamp),
+		StartTime:  ev.Timestamp,
+		FinishTime: ev.Timestamp + ev.Duration,
 		Tags:       ev.Tags,
 	}
 }
 
+// SpanToEvent keeps the start time in fractional milliseconds. The duration is
+// exact as long as the finish time is within a factor of two of the start
+// time (true of any epoch timestamp), so EventToSpan gets back the same
+// finish time.
 func SpanToEvent(s st.Span, entityName string, entityId string) SpanEvent {
 	return SpanEvent{
 		TraceId:    s.TraceId,
 		SpanId:     s.SpanId,
 		ParentId:   s.ParentId,
 		Name:       s.Name,
-		Timestamp:  uint64(s.StartTime),
+		Timestamp:  s.StartTime,
 		Duration:   s.FinishTime - s.StartTime,
 		Tags:       s.Tags,
 		EntityName: entityName,
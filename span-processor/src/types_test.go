@@ -0,0 +1,43 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"testing/quick"
+
+	st "shared/types"
+	stt "shared/typestest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventToSpan(t *testing.T) {
+	span := EventToSpan(SpanEvent{
+		Timestamp: 1549128157237.25,
+		Duration:  111.5,
+	})
+	assert.Equal(t, span.StartTime, 1549128157237.25, "should keep the fractional start time")
+	assert.Equal(t, span.FinishTime, 1549128157348.75, "should add the duration to the start time")
+}
+
+func TestSpanEventRoundTrip(t *testing.T) {
+	roundTrip := func(rs stt.RandomSpan, entityName string, entityId string) bool {
+		s := st.Span(rs)
+		ev := SpanToEvent(s, entityName, entityId)
+		return reflect.DeepEqual(EventToSpan(ev), s) &&
+			ev.EntityName == entityName &&
+			ev.EntityId == entityId
+	}
+	assert.Nil(t, quick.Check(roundTrip, nil), "spans should survive being turned into events")
+}
+
+func TestStoredSpanEventRoundTrip(t *testing.T) {
+	// the path a span takes from the recorder to the exporter and back
+	roundTrip := func(rs stt.RandomSpan) bool {
+		s := st.Span(rs)
+		stored := st.RecordToSpan(*st.SpanToRecord(s))
+		ev := SpanToEvent(*stored, "entity", "1")
+		return reflect.DeepEqual(*st.RecordToSpan(*st.SpanToRecord(EventToSpan(ev))), s)
+	}
+	assert.Nil(t, quick.Check(roundTrip, nil), "spans should survive storage and export")
+}
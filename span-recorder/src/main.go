@@ -5,42 +5,70 @@ import (
 	"strings"
 	"time"
 
+	sc "shared/config"
 	sdb "shared/db"
 	sm "shared/message"
 	st "shared/types"
-
-	"github.com/gocql/gocql"
 )
 
+// recordSpans stores every span in the message along with who sent it, and
+// adds them to the lookup tables.
+func recordSpans(store sdb.SpanStore, index sdb.SpanIndex, indexedTags []string, msg *st.SpanMessage, retention *sdb.RetentionPolicy, errHandler sm.ErrorReporter) {
+	rows := make([]st.SpanRow, len(msg.Spans))
+	summaries := make([]st.SpanSummary, len(msg.Spans))
+	tags := make([]st.TaggedSpanSummary, 0)
+	for i, span := range msg.Spans {
+		rows[i] = st.SpanRow{
+			SpanRecord: *st.SpanToRecord(span),
+			EntityName: msg.EntityName,
+			LicenseKey: msg.LicenseKey,
+			EntityId:   msg.EntityId,
+		}
+		summaries[i] = st.NewSpanSummary(span, msg.EntityName)
+		tags = append(tags, st.TagSummaries(summaries[i], span.Tags, indexedTags)...)
+	}
+	ttl := retention.TTL(msg.EntityName)
+	for _, err := range store.WriteSpans(rows, ttl) {
+		log.Print(err)
+		errHandler.HandleErr(
+			&msg.MessageId,
+			err,
+			"insert",
+		)
+	}
+	for _, err := range index.IndexSpans(summaries, tags, ttl) {
+		log.Print(err)
+		errHandler.HandleErr(
+			&msg.MessageId,
+			err,
+			"index",
+		)
+	}
+}
+
+// parseTags reads a comma separated list of tags.
+func parseTags(tags string) []string {
+	parsed := make([]string, 0)
+	for _, tag := range strings.Split(tags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			parsed = append(parsed, tag)
+		}
+	}
+	return parsed
+}
+
 func main() {
-	//setup cassandra
-	// TODO: make this less awful (e.g. do proper migrations)
-	// TODO?: tie this to the cassandra tags on the struct we are using
-	// to interface with this thing
-	KEYSPACE := "span_collector"
-	TABLE_NAME := KEYSPACE + ".spans"
-	tableSchema := map[string]string{
-		"trace_id":     "text",
-		"span_id":      "text",
-		"parent_id":    "text",
-		"name":         "text",
-		"sent":         "Boolean",
-		"start_time":   "double",
-		"finish_time":  "double",
-		"license_key":  "text",
-		"entity_id":    "text",
-		"entity_name":  "text",
-		"string_tags":  "map<text,text>",
-		"boolean_tags": "map<text,Boolean>",
-		"number_tags":  "map<text,double>",
+	openStore, err := sdb.BackendFromEnv()
+	if err != nil {
+		log.Fatal(err)
 	}
-	session, err := sdb.SetupCassandraSchema(KEYSPACE, TABLE_NAME, tableSchema, "trace_id, sent, span_id")
+	store, err := openStore()
 	for err != nil {
-		log.Print("ran into an error while setting up cassandra, waiting 5 seconds: ", err)
+		log.Print("ran into an error while opening the store, waiting 5 seconds: ", err)
 		time.Sleep(5 * time.Second)
-		session, err = sdb.SetupCassandraSchema(KEYSPACE, TABLE_NAME, tableSchema, "trace_id, sent, span_id")
+		store, err = openStore()
 	}
-	defer session.Close()
+	defer store.Close()
 
 	//read from kafka
 	reader := sm.NewSpanMessageConsumer("span-recorders")
@@ -49,63 +77,11 @@ func main() {
 
 	errHandler := sm.NewErrorHandler("span-recorder")
 
-	go func() {
-		for {
-			result := make(map[string]interface{})
-			e := session.Query("SELECT COUNT(*) FROM " + TABLE_NAME).MapScan(result)
-			log.Println("counts yo:", result)
-			log.Println("err yo:", e)
-			time.Sleep(10 * time.Second)
-		}
-	}()
+	retention := sdb.NewRetentionPolicyFromEnv()
 
-	placeholderValues := []string{"?"}
+	indexedTags := parseTags(sc.String("INDEXED_TAGS", "error,http.status_code"))
 
 	for msg := range msgChan {
-		batch := gocql.NewBatch(gocql.LoggedBatch)
-		// TODO: break this up into smaller chunks, cassandra will only
-		// accept payloads less than 50kb
-		for _, span := range msg.Spans {
-			record := st.SpanToRecord(span)
-			fields, spanValues := sdb.GetKeysAndValues(*record)
-
-			// Add on all the message level info
-			*fields = append(*fields, "entity_name")
-			*spanValues = append(*spanValues, msg.EntityName)
-
-			if msg.LicenseKey != "" {
-				*fields = append(*fields, "license_key")
-				*spanValues = append(*spanValues, msg.LicenseKey)
-			}
-
-			if msg.EntityId != "" {
-				*fields = append(*fields, "entity_id")
-				*spanValues = append(*spanValues, msg.EntityId)
-			}
-			query := "INSERT INTO " + TABLE_NAME + " (sent, " + strings.Join(*fields, ",") + ") VALUES (false, " + sdb.MakePlaceholderString(&placeholderValues, len(*fields)) + ");"
-			batch.Query(query, *spanValues...)
-			if batch.Size() >= 10 {
-				err := session.ExecuteBatch(batch)
-				if err != nil {
-					log.Print(err)
-					errHandler.HandleErr(
-						&msg.MessageId,
-						err,
-						"insert",
-					)
-				}
-				batch = gocql.NewBatch(gocql.LoggedBatch)
-			}
-		}
-
-		err := session.ExecuteBatch(batch)
-		if err != nil {
-			log.Print(err)
-			errHandler.HandleErr(
-				&msg.MessageId,
-				err,
-				"insert",
-			)
-		}
+		recordSpans(store, store, indexedTags, &msg, retention, errHandler)
 	}
 }
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	sdb "shared/db"
+	st "shared/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type reportedError struct {
+	messageId string
+	event     string
+}
+
+type testErrorReporter struct {
+	errors []reportedError
+}
+
+func (r *testErrorReporter) HandleErr(messageId *string, err error, event string) {
+	r.errors = append(r.errors, reportedError{*messageId, event})
+}
+
+type failingSpanStore struct {
+	*sdb.MemoryStore
+}
+
+func (f failingSpanStore) WriteSpans(rows []st.SpanRow, ttl int) []error {
+	return []error{errors.New("cassandra is down")}
+}
+
+type testSpanIndex struct {
+	*sdb.MemoryStore
+	spans []st.SpanSummary
+	tags  []st.TaggedSpanSummary
+}
+
+func (i *testSpanIndex) IndexSpans(spans []st.SpanSummary, tags []st.TaggedSpanSummary, ttl int) []error {
+	i.spans = append(i.spans, spans...)
+	i.tags = append(i.tags, tags...)
+	return nil
+}
+
+func TestRecordSpans(t *testing.T) {
+	store := sdb.NewMemoryStore()
+	reporter := &testErrorReporter{}
+	msg := &st.SpanMessage{
+		EntityName: "checkout",
+		LicenseKey: "key",
+		MessageId:  "m1",
+		Spans: []st.Span{
+			{TraceId: "t1", SpanId: "a", Tags: map[string]interface{}{"error": true}},
+			{TraceId: "t1", SpanId: "b", ParentId: "a"},
+		},
+	}
+	index := &testSpanIndex{MemoryStore: sdb.NewMemoryStore()}
+	recordSpans(store, index, []string{"error"}, msg, &sdb.RetentionPolicy{}, reporter)
+
+	rows, _ := store.TraceSpans("t1")
+	assert.Equal(t, len(rows), 2)
+	assert.Equal(t, rows[0].EntityName, "checkout", "should keep who sent the span")
+	assert.Equal(t, rows[0].LicenseKey, "key")
+	assert.True(t, rows[0].BooleanTags["error"])
+	assert.Empty(t, reporter.errors)
+
+	assert.Equal(t, len(index.spans), 2, "should index every span")
+	assert.Equal(t, index.spans[0].EntityName, "checkout")
+	assert.Equal(t, len(index.tags), 1, "should index the configured tags")
+	assert.Equal(t, index.tags[0].SpanId, "a")
+	assert.Equal(t, index.tags[0].Value, "true")
+
+	recordSpans(failingSpanStore{store}, index, nil, msg, &sdb.RetentionPolicy{}, reporter)
+	assert.Equal(t, reporter.errors, []reportedError{{"m1", "insert"}}, "should report failed writes")
+}
+
+func TestParseTags(t *testing.T) {
+	assert.Equal(t, parseTags(" error, http.status_code,,"), []string{"error", "http.status_code"})
+	assert.Empty(t, parseTags(""))
+}
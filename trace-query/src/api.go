@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	sdb "shared/db"
+	stree "shared/trace"
+	st "shared/types"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	DEFAULT_PAGE_SIZE = 20
+	MAX_PAGE_SIZE     = 100
+)
+
+// QueryServer serves stored traces, and searches over the span lookup
+// tables.
+type QueryServer struct {
+	spans      sdb.SpanStore
+	index      sdb.SpanIndex
+	selections sdb.TraceSelectionStore
+	errors     sdb.ErrorStore
+	searcher   *Searcher
+	// the longest time range a search or error query may cover
+	maxRange time.Duration
+}
+
+// TraceResponse is an assembled trace, with the entity each span came from
+// and why the trace was selected.
+type TraceResponse struct {
+	*stree.Trace
+	Entities   map[string]string     `json:"entities"`
+	Selections []st.InterestingTrace `json:"selections"`
+}
+
+func NewQueryServer(spans sdb.SpanStore, index sdb.SpanIndex, selections sdb.TraceSelectionStore, errors sdb.ErrorStore, maxRange time.Duration, indexedTags []string) *QueryServer {
+	return &QueryServer{
+		spans:      spans,
+		index:      index,
+		selections: selections,
+		errors:     errors,
+		searcher:   NewSearcher(spans, index, indexedTags),
+		maxRange:   maxRange,
+	}
+}
+
+func (q *QueryServer) Router() *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/traces", q.searchTraces).Methods("GET")
+	r.HandleFunc("/traces/{traceId}", q.getTrace).Methods("GET")
+	r.HandleFunc("/entities", q.listEntities).Methods("GET")
+	r.HandleFunc("/entities/{entity}/span-names", q.listSpanNames).Methods("GET")
+	r.HandleFunc("/errors", q.listErrors).Methods("GET")
+	r.HandleFunc("/errors/counts", q.countErrors).Methods("GET")
+	r.PathPrefix("/").Handler(UIHandler()).Methods("GET")
+	return r
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Print(err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// Trace assembles the stored spans of a trace, or gives nil if there are
+// none.
+func (q *QueryServer) Trace(traceId string) (*TraceResponse, error) {
+	rows, err := q.spans.TraceSpans(traceId)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	spans := make([]st.Span, 0, len(rows))
+	entities := make(map[string]string)
+	for _, row := range rows {
+		spans = append(spans, *st.RecordToSpan(row.SpanRecord))
+		entities[row.SpanId] = row.EntityName
+	}
+	selections, err := q.selections.TraceSelections(traceId)
+	if err != nil {
+		return nil, err
+	}
+	return &TraceResponse{
+		Trace:      stree.Assemble(spans),
+		Entities:   entities,
+		Selections: selections,
+	}, nil
+}
+
+func (q *QueryServer) getTrace(w http.ResponseWriter, r *http.Request) {
+	traceId := mux.Vars(r)["traceId"]
+	trace, err := q.Trace(traceId)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if trace == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no spans found for trace %s", traceId))
+		return
+	}
+	writeJSON(w, http.StatusOK, trace)
+}
+
+func param(params map[string][]string, name string) string {
+	if values, ok := params[name]; ok {
+		return values[0]
+	}
+	return ""
+}
+
+func floatParam(params map[string][]string, name string, fallback float64) (float64, error) {
+	values, ok := params[name]
+	if !ok || values[0] == "" {
+		return fallback, nil
+	}
+	value, err := strconv.ParseFloat(values[0], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %s", name, values[0])
+	}
+	return value, nil
+}
+
+// timeRange reads the from and to parameters, in milliseconds since the
+// epoch. They default to the last hour.
+func timeRange(params map[string][]string, now time.Time, maxRange time.Duration) (float64, float64, error) {
+	nowMs := float64(now.UnixNano() / int64(time.Millisecond))
+	to, err := floatParam(params, "to", nowMs)
+	if err != nil {
+		return 0, 0, err
+	}
+	from, err := floatParam(params, "from", to-float64(time.Hour/time.Millisecond))
+	if err != nil {
+		return 0, 0, err
+	}
+	if from > to {
+		return 0, 0, errors.New("from is after to")
+	}
+	if maxRange > 0 && to-from > float64(maxRange/time.Millisecond) {
+		return 0, 0, fmt.Errorf("queries can cover at most %s", maxRange)
+	}
+	return from, to, nil
+}
+
+// ParseSearch reads a search from query parameters. Times are in
+// milliseconds since the epoch, and default to the last hour.
+func ParseSearch(params map[string][]string, now time.Time, maxRange time.Duration) (*Search, error) {
+	get := func(name string) string {
+		return param(params, name)
+	}
+	search := &Search{
+		EntityName: get("entity"),
+		Name:       get("name"),
+		Tags:       make(map[string]string),
+		Limit:      DEFAULT_PAGE_SIZE,
+	}
+	for _, tag := range params["tag"] {
+		parts := strings.SplitN(tag, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid tag %q, expected key:value", tag)
+		}
+		search.Tags[parts[0]] = parts[1]
+	}
+
+	var err error
+	if search.From, search.To, err = timeRange(params, now, maxRange); err != nil {
+		return nil, err
+	}
+	if search.MinDuration, err = floatParam(params, "min_duration", 0); err != nil {
+		return nil, err
+	}
+	if search.MaxDuration, err = floatParam(params, "max_duration", 0); err != nil {
+		return nil, err
+	}
+
+	if limit := get("limit"); limit != "" {
+		search.Limit, err = strconv.Atoi(limit)
+		if err != nil || search.Limit <= 0 {
+			return nil, fmt.Errorf("invalid limit: %s", limit)
+		}
+		if search.Limit > MAX_PAGE_SIZE {
+			search.Limit = MAX_PAGE_SIZE
+		}
+	}
+	if cursor := get("cursor"); cursor != "" {
+		if search.Cursor, err = DecodeCursor(cursor); err != nil {
+			return nil, err
+		}
+	}
+	return search, nil
+}
+
+func (q *QueryServer) searchTraces(w http.ResponseWriter, r *http.Request) {
+	search, err := ParseSearch(r.URL.Query(), time.Now(), q.maxRange)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	result, err := q.searcher.Search(search)
+	if err == errNoLookup || err == errNoIndexedTag {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (q *QueryServer) listEntities(w http.ResponseWriter, r *http.Request) {
+	entities, err := q.index.Entities()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, entities)
+}
+
+func (q *QueryServer) listSpanNames(w http.ResponseWriter, r *http.Request) {
+	names, err := q.index.SpanNames(mux.Vars(r)["entity"])
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, names)
+}
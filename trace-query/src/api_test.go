@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	sdb "shared/db"
+	st "shared/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func get(t *testing.T, server *QueryServer, path string, body interface{}) int {
+	rec := httptest.NewRecorder()
+	server.Router().ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), body))
+	return rec.Code
+}
+
+func TestGetTrace(t *testing.T) {
+	store := sdb.NewMemoryStore()
+	root := span("t1", "a", "GET /cart", 1000, 100, nil)
+	child := span("t1", "b", "db.query", 1010, 20, nil)
+	child.ParentId = "a"
+	storeSpans(store, "checkout", root)
+	storeSpans(store, "db", child)
+	store.SaveSelections([]*st.InterestingTrace{st.NewInterestingTrace("t1", "latency")}, 60)
+	server := NewQueryServer(store, store, store, store, time.Hour, indexedTags)
+
+	res := struct {
+		TraceId string `json:"trace_id"`
+		Roots   []struct {
+			Span     st.Span `json:"span"`
+			Children []struct {
+				Span st.Span `json:"span"`
+			} `json:"children"`
+		} `json:"roots"`
+		Entities   map[string]string     `json:"entities"`
+		Selections []st.InterestingTrace `json:"selections"`
+	}{}
+	code := get(t, server, "/traces/t1", &res)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, res.TraceId, "t1")
+	assert.Equal(t, len(res.Roots), 1)
+	assert.Equal(t, res.Roots[0].Span.SpanId, "a")
+	assert.Equal(t, len(res.Roots[0].Children), 1)
+	assert.Equal(t, res.Roots[0].Children[0].Span.SpanId, "b")
+	assert.Equal(t, res.Entities, map[string]string{"a": "checkout", "b": "db"})
+	assert.Equal(t, len(res.Selections), 1)
+	assert.Equal(t, res.Selections[0].Reason, "latency", "should say why the trace was kept")
+
+	code = get(t, server, "/traces/nope", &map[string]string{})
+	assert.Equal(t, code, http.StatusNotFound)
+}
+
+func TestSearchTraces(t *testing.T) {
+	store := sdb.NewMemoryStore()
+	storeSpans(store, "checkout",
+		span("t1", "a", "GET /cart", 1000, 50, map[string]interface{}{"http.status_code": 500}),
+		span("t2", "a", "GET /cart", 2000, 50, map[string]interface{}{"http.status_code": 200}),
+	)
+	storeSpans(store, "cart", span("t3", "a", "GET /cart", 3000, 50, map[string]interface{}{"user.id": 1}))
+	server := NewQueryServer(store, store, store, store, time.Hour, indexedTags)
+
+	res := &SearchResult{}
+	code := get(t, server, "/traces?entity=checkout&from=0&to=10000&limit=1", res)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, traceIds(res), []string{"t2"})
+	assert.NotEqual(t, res.NextCursor, "")
+
+	code = get(t, server, "/traces?entity=checkout&from=0&to=10000&limit=1&cursor="+res.NextCursor, res)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, traceIds(res), []string{"t1"})
+
+	code = get(t, server, "/traces?tag=http.status_code:500&from=0&to=10000", res)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, traceIds(res), []string{"t1"})
+
+	code = get(t, server, "/traces?entity=cart&tag=user.id:1&from=0&to=10000", res)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, traceIds(res), []string{"t3"}, "should fall back to the entity for tags that aren't indexed")
+
+	for _, path := range []string{
+		"/traces?from=0&to=10000",
+		"/traces?entity=checkout&from=10000&to=0",
+		"/traces?entity=checkout&from=0&to=7200000",
+		"/traces?entity=checkout&tag=nocolon",
+		"/traces?tag=user.id:1&from=0&to=10000",
+		"/traces?entity=checkout&limit=zero",
+		"/traces?entity=checkout&cursor=!!",
+	} {
+		code = get(t, server, path, &map[string]string{})
+		assert.Equal(t, code, http.StatusBadRequest, path)
+	}
+}
+
+func TestParseSearch(t *testing.T) {
+	now := time.Unix(7200, 0)
+	search, err := ParseSearch(map[string][]string{
+		"name":  {"GET /cart"},
+		"tag":   {"error:true", "url:http://example.com"},
+		"limit": {"1000"},
+	}, now, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, search.To, float64(7200000))
+	assert.Equal(t, search.From, float64(3600000), "should default to the last hour")
+	assert.Equal(t, search.Tags, map[string]string{"error": "true", "url": "http://example.com"})
+	assert.Equal(t, search.Limit, MAX_PAGE_SIZE)
+}
+
+func TestListEntities(t *testing.T) {
+	store := sdb.NewMemoryStore()
+	storeSpans(store, "search", span("t1", "a", "GET /", 1000, 1, nil))
+	storeSpans(store, "checkout", span("t2", "a", "GET /cart", 1000, 1, nil), span("t2", "b", "db.query", 1000, 1, nil))
+	server := NewQueryServer(store, store, store, store, time.Hour, indexedTags)
+
+	entities := make([]string, 0)
+	assert.Equal(t, get(t, server, "/entities", &entities), http.StatusOK)
+	assert.Equal(t, entities, []string{"checkout", "search"})
+
+	names := make([]string, 0)
+	assert.Equal(t, get(t, server, "/entities/checkout/span-names", &names), http.StatusOK)
+	assert.Equal(t, names, []string{"GET /cart", "db.query"})
+}
+
+func TestUI(t *testing.T) {
+	store := sdb.NewMemoryStore()
+	server := NewQueryServer(store, store, store, store, time.Hour, indexedTags)
+
+	for path, contentType := range map[string]string{
+		"/":          "text/html",
+		"/app.js":    "javascript",
+		"/style.css": "text/css",
+	} {
+		rec := httptest.NewRecorder()
+		server.Router().ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, rec.Code, http.StatusOK, path)
+		assert.True(t, strings.Contains(rec.Header().Get("Content-Type"), contentType), path)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	sdb "shared/db"
+)
+
+const (
+	DEFAULT_ERROR_LIMIT = 100
+	MAX_ERROR_LIMIT     = 1000
+)
+
+func msToTime(ms float64) time.Time {
+	return time.Unix(0, int64(ms*float64(time.Millisecond)))
+}
+
+// ParseErrorFilter reads which system errors to list from query parameters.
+// Times are in milliseconds since the epoch, and default to the last hour.
+func ParseErrorFilter(params map[string][]string, now time.Time, maxRange time.Duration) (*sdb.ErrorFilter, error) {
+	from, to, err := timeRange(params, now, maxRange)
+	if err != nil {
+		return nil, err
+	}
+	filter := &sdb.ErrorFilter{
+		Component: param(params, "component"),
+		Event:     param(params, "event"),
+		MessageId: param(params, "message_id"),
+		From:      msToTime(from),
+		To:        msToTime(to),
+		Limit:     DEFAULT_ERROR_LIMIT,
+	}
+	if param(params, "to") == "" {
+		// errors from the last millisecond shouldn't be rounded away
+		filter.To = now
+	}
+	if limit := param(params, "limit"); limit != "" {
+		filter.Limit, err = strconv.Atoi(limit)
+		if err != nil || filter.Limit <= 0 {
+			return nil, fmt.Errorf("invalid limit: %s", limit)
+		}
+		if filter.Limit > MAX_ERROR_LIMIT {
+			filter.Limit = MAX_ERROR_LIMIT
+		}
+	}
+	return filter, nil
+}
+
+func (q *QueryServer) listErrors(w http.ResponseWriter, r *http.Request) {
+	filter, err := ParseErrorFilter(r.URL.Query(), time.Now(), q.maxRange)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	errs, err := q.errors.FindErrors(*filter)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, errs)
+}
+
+func (q *QueryServer) countErrors(w http.ResponseWriter, r *http.Request) {
+	filter, err := ParseErrorFilter(r.URL.Query(), time.Now(), q.maxRange)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	counts, err := q.errors.ErrorCounts(*filter)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, counts)
+}
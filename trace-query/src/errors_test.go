@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	sdb "shared/db"
+	st "shared/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListErrors(t *testing.T) {
+	store := sdb.NewMemoryStore()
+	for _, e := range []*st.Error{
+		st.NewError("could not write spans", "", "span-recorder", "insert"),
+		st.NewError("could not index spans", "", "span-recorder", "index"),
+		st.NewError("could not publish selection", "", "trace-selector", "publish"),
+	} {
+		e.MessageId = "m1"
+		store.SaveError(e)
+	}
+	server := NewQueryServer(store, store, store, store, time.Hour, indexedTags)
+
+	errs := make([]st.Error, 0)
+	assert.Equal(t, get(t, server, "/errors", &errs), http.StatusOK)
+	assert.Equal(t, len(errs), 3, "should list the last hour by default")
+
+	assert.Equal(t, get(t, server, "/errors?component=span-recorder&event=index", &errs), http.StatusOK)
+	assert.Equal(t, len(errs), 1)
+	assert.Equal(t, errs[0].Message, "could not index spans")
+	assert.Equal(t, errs[0].MessageId, "m1")
+
+	assert.Equal(t, get(t, server, "/errors?message_id=m2", &errs), http.StatusOK)
+	assert.Empty(t, errs)
+
+	counts := make(map[string]int)
+	assert.Equal(t, get(t, server, "/errors/counts", &counts), http.StatusOK)
+	assert.Equal(t, counts, map[string]int{"span-recorder": 2, "trace-selector": 1})
+
+	assert.Equal(t, get(t, server, "/errors?limit=-1", &map[string]string{}), http.StatusBadRequest)
+	assert.Equal(t, get(t, server, "/errors/counts?from=0", &map[string]string{}), http.StatusBadRequest, "should limit the time range")
+}
+
+func TestParseErrorFilter(t *testing.T) {
+	now := time.Unix(7200, 0)
+	filter, err := ParseErrorFilter(map[string][]string{
+		"component": {"span-recorder"},
+		"from":      {"1000"},
+		"to":        {"2500"},
+		"limit":     {"5000"},
+	}, now, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, filter.Component, "span-recorder")
+	assert.True(t, filter.From.Equal(time.Unix(1, 0)))
+	assert.True(t, filter.To.Equal(time.Unix(2, int64(500*time.Millisecond))))
+	assert.Equal(t, filter.Limit, MAX_ERROR_LIMIT)
+}
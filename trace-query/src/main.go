@@ -0,0 +1,49 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	sc "shared/config"
+	sdb "shared/db"
+)
+
+// parseTags reads a comma separated list of tags.
+func parseTags(tags string) []string {
+	parsed := make([]string, 0)
+	for _, tag := range strings.Split(tags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			parsed = append(parsed, tag)
+		}
+	}
+	return parsed
+}
+
+func main() {
+	openStore, err := sdb.BackendFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	store, err := openStore()
+	for err != nil {
+		log.Print("ran into an error while opening the store, waiting 5 seconds: ", err)
+		time.Sleep(5 * time.Second)
+		store, err = openStore()
+	}
+	defer store.Close()
+
+	server := NewQueryServer(
+		store,
+		store,
+		store,
+		store,
+		sc.Duration("SEARCH_MAX_RANGE", 24*time.Hour),
+		parseTags(sc.String("INDEXED_TAGS", "error,http.status_code")),
+	)
+	// the query API has no auth, so only listen locally unless told to
+	addr := sc.String("QUERY_ADDR", "127.0.0.1:12347")
+	log.Print("Query API listening on ", addr)
+	log.Fatal(http.ListenAndServe(addr, server.Router()))
+}
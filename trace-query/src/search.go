@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	sdb "shared/db"
+	st "shared/types"
+)
+
+// Search is what to look for: traces with a span from the entity, with the
+// name and tags given, that started in the time range. At least one of an
+// entity, span name or indexed tag is needed to pick a lookup table to
+// search.
+type Search struct {
+	EntityName string
+	Name       string
+	Tags       map[string]string
+	// milliseconds since the epoch
+	From float64
+	To   float64
+	// bounds on the whole trace's duration in milliseconds, zero for no
+	// bound
+	MinDuration float64
+	MaxDuration float64
+	// traces per page
+	Limit  int
+	Cursor *Cursor
+}
+
+// Cursor is the last span on a page. Spans are listed most recent first,
+// ties broken by trace and span id.
+type Cursor struct {
+	StartTime float64 `json:"s"`
+	TraceId   string  `json:"t"`
+	SpanId    string  `json:"i"`
+}
+
+// TraceSummary is a trace found by a search.
+type TraceSummary struct {
+	TraceId string `json:"trace_id"`
+	// the root span, or the earliest span when there's more than one
+	EntityName string  `json:"entity_name"`
+	Name       string  `json:"name"`
+	StartTime  float64 `json:"start_time"`
+	// from the start of the earliest span to the end of the latest
+	Duration  float64 `json:"duration"`
+	SpanCount int     `json:"span_count"`
+	// the spans that matched the search, most recent first
+	Matches []st.SpanSummary `json:"matches"`
+}
+
+type SearchResult struct {
+	Traces     []*TraceSummary `json:"traces"`
+	NextCursor string          `json:"next_cursor,omitempty"`
+}
+
+var errNoLookup = errors.New("an entity, span name or tag is needed to search by")
+var errNoIndexedTag = errors.New("none of the tags are indexed (see INDEXED_TAGS), an entity or span name is needed to search by as well")
+
+func cursorOf(span st.SpanSummary) *Cursor {
+	return &Cursor{StartTime: span.StartTime, TraceId: span.TraceId, SpanId: span.SpanId}
+}
+
+// precedes tells whether span comes after the cursor.
+func (c *Cursor) precedes(span st.SpanSummary) bool {
+	if span.StartTime != c.StartTime {
+		return span.StartTime < c.StartTime
+	}
+	if span.TraceId != c.TraceId {
+		return span.TraceId > c.TraceId
+	}
+	return span.SpanId > c.SpanId
+}
+
+func (c *Cursor) Encode() string {
+	encoded, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+func DecodeCursor(cursor string) (*Cursor, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor: %v", err)
+	}
+	c := &Cursor{}
+	if err := json.Unmarshal(decoded, c); err != nil {
+		return nil, fmt.Errorf("invalid cursor: %v", err)
+	}
+	return c, nil
+}
+
+// Searcher finds spans using the lookup tables, filtering out anything the
+// table it searched can't.
+type Searcher struct {
+	spans sdb.SpanStore
+	index sdb.SpanIndex
+	// the tags span-recorder indexes, only these can be looked up
+	indexedTags map[string]bool
+}
+
+func NewSearcher(spans sdb.SpanStore, index sdb.SpanIndex, indexedTags []string) *Searcher {
+	indexed := make(map[string]bool, len(indexedTags))
+	for _, tag := range indexedTags {
+		indexed[tag] = true
+	}
+	return &Searcher{
+		spans:       spans,
+		index:       index,
+		indexedTags: indexed,
+	}
+}
+
+// lookup picks the table to search. Tags are the most selective, so the
+// first indexed tag (by name) is used when there are any. Other tags are
+// checked against the spans found.
+func (s *Search) lookup(indexedTags map[string]bool) (sdb.Lookup, error) {
+	tags := make([]string, 0, len(s.Tags))
+	for tag := range s.Tags {
+		if indexedTags[tag] {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) > 0 {
+		sort.Strings(tags)
+		return sdb.Lookup{Tag: tags[0], Value: s.Tags[tags[0]]}, nil
+	}
+	if s.Name != "" {
+		return sdb.Lookup{Name: s.Name}, nil
+	}
+	if s.EntityName != "" {
+		return sdb.Lookup{EntityName: s.EntityName}, nil
+	}
+	if len(s.Tags) > 0 {
+		return sdb.Lookup{}, errNoIndexedTag
+	}
+	return sdb.Lookup{}, errNoLookup
+}
+
+// foundTrace is a trace a search has come across, loaded in full.
+type foundTrace struct {
+	summary *TraceSummary
+	// the span the trace is listed at, its most recent match
+	listedAt *st.SpanSummary
+}
+
+// listedBefore orders spans the way searches list them.
+func listedBefore(a st.SpanSummary, b st.SpanSummary) bool {
+	return cursorOf(a).precedes(b)
+}
+
+// spanMatches checks a span against everything but the trace's duration.
+func (search *Search) spanMatches(span st.SpanSummary, tags map[string]interface{}) bool {
+	if search.EntityName != "" && span.EntityName != search.EntityName {
+		return false
+	}
+	if search.Name != "" && span.Name != search.Name {
+		return false
+	}
+	if span.StartTime < search.From || span.StartTime > search.To {
+		return false
+	}
+	for tag, value := range search.Tags {
+		// the way tags are indexed
+		v, ok := tags[tag]
+		if !ok || v == nil || fmt.Sprint(v) != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (search *Search) durationMatches(duration float64) bool {
+	return (search.MinDuration <= 0 || duration >= search.MinDuration) &&
+		(search.MaxDuration <= 0 || duration <= search.MaxDuration)
+}
+
+// loadTrace reads a trace's spans, and works out its summary and which of its
+// spans match the search.
+func (s *Searcher) loadTrace(search *Search, traceId string) (*foundTrace, error) {
+	rows, err := s.spans.TraceSpans(traceId)
+	if err != nil {
+		return nil, err
+	}
+	found := &foundTrace{summary: &TraceSummary{
+		TraceId:   traceId,
+		SpanCount: len(rows),
+		Matches:   make([]st.SpanSummary, 0),
+	}}
+	if len(rows) == 0 {
+		return found, nil
+	}
+	spanIds := make(map[string]bool, len(rows))
+	for _, row := range rows {
+		spanIds[row.SpanId] = true
+	}
+	var root *st.SpanSummary
+	start, finish := rows[0].StartTime, rows[0].FinishTime
+	for _, row := range rows {
+		span := st.RecordToSpan(row.SpanRecord)
+		summary := st.NewSpanSummary(*span, row.EntityName)
+		if span.StartTime < start {
+			start = span.StartTime
+		}
+		if span.FinishTime > finish {
+			finish = span.FinishTime
+		}
+		if (span.ParentId == "" || !spanIds[span.ParentId]) && (root == nil || span.StartTime < root.StartTime) {
+			root = &summary
+		}
+		if search.spanMatches(summary, span.Tags) {
+			found.summary.Matches = append(found.summary.Matches, summary)
+		}
+	}
+	if root != nil {
+		found.summary.EntityName = root.EntityName
+		found.summary.Name = root.Name
+	}
+	found.summary.StartTime = start
+	found.summary.Duration = finish - start
+	sort.Slice(found.summary.Matches, func(i, j int) bool {
+		return listedBefore(found.summary.Matches[i], found.summary.Matches[j])
+	})
+	if len(found.summary.Matches) > 0 {
+		found.listedAt = &found.summary.Matches[0]
+	}
+	return found, nil
+}
+
+// Search walks back an hour at a time from the end of the time range (or the
+// cursor) through the spans in the lookup table. Each trace is listed once,
+// at its most recent matching span, so it doesn't show up again on later
+// pages.
+func (s *Searcher) Search(search *Search) (*SearchResult, error) {
+	lookup, err := search.lookup(s.indexedTags)
+	if err != nil {
+		return nil, err
+	}
+	result := &SearchResult{Traces: make([]*TraceSummary, 0)}
+	traces := make(map[string]*foundTrace)
+
+	pos := search.Cursor
+	to := search.To
+	if pos != nil && pos.StartTime < to {
+		to = pos.StartTime
+	}
+	for hour := st.HourOf(to); hour >= st.HourOf(search.From); hour-- {
+		fetch := search.Limit
+		for {
+			spans, err := s.index.FindSpans(lookup, hour, search.From, to, fetch)
+			if err != nil {
+				return nil, err
+			}
+			progressed := false
+			for _, span := range spans {
+				// spans starting at the same time as the last one
+				// seen come back again
+				if pos != nil && !pos.precedes(span) {
+					continue
+				}
+				progressed = true
+				pos = cursorOf(span)
+				trace, ok := traces[span.TraceId]
+				if !ok {
+					if trace, err = s.loadTrace(search, span.TraceId); err != nil {
+						return nil, err
+					}
+					traces[span.TraceId] = trace
+				}
+				listed := trace.listedAt != nil && trace.listedAt.SpanId == span.SpanId
+				if !listed || !search.durationMatches(trace.summary.Duration) {
+					continue
+				}
+				result.Traces = append(result.Traces, trace.summary)
+				if len(result.Traces) == search.Limit {
+					result.NextCursor = pos.Encode()
+					return result, nil
+				}
+			}
+			if len(spans) < fetch {
+				break
+			}
+			if !progressed {
+				// a lot of spans started at the same time
+				fetch *= 2
+				continue
+			}
+			to = pos.StartTime
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	sdb "shared/db"
+	st "shared/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var indexedTags = []string{"error", "http.status_code"}
+
+// storeSpans writes and indexes spans the way span-recorder does.
+func storeSpans(store *sdb.MemoryStore, entityName string, spans ...st.Span) {
+	rows := make([]st.SpanRow, len(spans))
+	summaries := make([]st.SpanSummary, len(spans))
+	tags := make([]st.TaggedSpanSummary, 0)
+	for i, span := range spans {
+		rows[i] = st.SpanRow{SpanRecord: *st.SpanToRecord(span), EntityName: entityName}
+		summaries[i] = st.NewSpanSummary(span, entityName)
+		tags = append(tags, st.TagSummaries(summaries[i], span.Tags, indexedTags)...)
+	}
+	store.WriteSpans(rows, 60)
+	store.IndexSpans(summaries, tags, 60)
+}
+
+func span(traceId string, spanId string, name string, start float64, duration float64, tags map[string]interface{}) st.Span {
+	if tags == nil {
+		tags = make(map[string]interface{})
+	}
+	return st.Span{
+		TraceId:    traceId,
+		SpanId:     spanId,
+		Name:       name,
+		StartTime:  start,
+		FinishTime: start + duration,
+		Tags:       tags,
+	}
+}
+
+func traceIds(result *SearchResult) []string {
+	ids := make([]string, len(result.Traces))
+	for i, trace := range result.Traces {
+		ids[i] = trace.TraceId
+	}
+	return ids
+}
+
+func TestSearchNeedsLookup(t *testing.T) {
+	store := sdb.NewMemoryStore()
+	_, err := NewSearcher(store, store, indexedTags).Search(&Search{To: 1000, Limit: 10})
+	assert.Equal(t, err, errNoLookup)
+}
+
+func TestSearchFilters(t *testing.T) {
+	store := sdb.NewMemoryStore()
+	storeSpans(store, "checkout",
+		span("t1", "a", "GET /cart", 1000, 50, map[string]interface{}{"error": true, "http.status_code": 500}),
+		span("t2", "a", "GET /cart", 2000, 500, map[string]interface{}{"error": true, "http.status_code": 502}),
+		span("t3", "a", "db.query", 3000, 5, map[string]interface{}{"error": true, "http.status_code": 500}),
+	)
+	storeSpans(store, "search", span("t4", "a", "GET /cart", 4000, 50, nil))
+	searcher := NewSearcher(store, store, indexedTags)
+
+	result, err := searcher.Search(&Search{EntityName: "checkout", From: 0, To: 10000, Limit: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, traceIds(result), []string{"t3", "t2", "t1"}, "should list the most recent first")
+
+	result, _ = searcher.Search(&Search{EntityName: "checkout", Name: "GET /cart", From: 0, To: 10000, Limit: 10})
+	assert.Equal(t, traceIds(result), []string{"t2", "t1"})
+
+	result, _ = searcher.Search(&Search{Name: "GET /cart", MinDuration: 40, MaxDuration: 100, From: 0, To: 10000, Limit: 10})
+	assert.Equal(t, traceIds(result), []string{"t4", "t1"})
+
+	result, _ = searcher.Search(&Search{Tags: map[string]string{"error": "true", "http.status_code": "500"}, From: 0, To: 10000, Limit: 10})
+	assert.Equal(t, traceIds(result), []string{"t3", "t1"}, "should check tags the lookup didn't")
+
+	result, err = searcher.Search(&Search{EntityName: "checkout", Tags: map[string]string{"http.status_code": "502", "db.type": "sql"}, From: 0, To: 10000, Limit: 10})
+	assert.Nil(t, err)
+	assert.Empty(t, traceIds(result), "should look up by the indexed tag and check the rest")
+
+	_, err = searcher.Search(&Search{Tags: map[string]string{"db.type": "sql"}, From: 0, To: 10000, Limit: 10})
+	assert.Equal(t, err, errNoIndexedTag, "should need something indexed to search by")
+
+	result, _ = searcher.Search(&Search{EntityName: "checkout", From: 1500, To: 2500, Limit: 10})
+	assert.Equal(t, traceIds(result), []string{"t2"})
+}
+
+func TestSearchPages(t *testing.T) {
+	store := sdb.NewMemoryStore()
+	spans := make([]st.Span, 0)
+	for i := 0; i < 5; i++ {
+		// spread over a few hours
+		spans = append(spans, span(fmt.Sprintf("t%d", i), "a", "work", float64(i)*st.HOUR_MS, 1, nil))
+	}
+	// spans starting together have to be paged through as well
+	for i := 0; i < 4; i++ {
+		spans = append(spans, span("t9", fmt.Sprintf("b%d", i), "work", 4*st.HOUR_MS, 1, nil))
+	}
+	storeSpans(store, "checkout", spans...)
+	searcher := NewSearcher(store, store, indexedTags)
+
+	seen := make([]string, 0)
+	search := &Search{EntityName: "checkout", From: 0, To: 5 * st.HOUR_MS, Limit: 2}
+	for pages := 0; pages < 10; pages++ {
+		result, err := searcher.Search(search)
+		assert.Nil(t, err)
+		seen = append(seen, traceIds(result)...)
+		if result.NextCursor == "" {
+			break
+		}
+		search.Cursor, err = DecodeCursor(result.NextCursor)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, seen, []string{"t4", "t9", "t3", "t2", "t1", "t0"}, "should list each trace once")
+}
+
+func TestSearchSkipsNonMatchingPages(t *testing.T) {
+	store := sdb.NewMemoryStore()
+	spans := make([]st.Span, 0)
+	for i := 0; i < 10; i++ {
+		spans = append(spans, span(fmt.Sprintf("t%d", i), "a", "work", float64(1000+i), 1, nil))
+	}
+	spans = append(spans, span("slow", "a", "work", 500, 1000, nil))
+	storeSpans(store, "checkout", spans...)
+
+	result, err := NewSearcher(store, store, indexedTags).Search(&Search{EntityName: "checkout", MinDuration: 100, From: 0, To: 10000, Limit: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, traceIds(result), []string{"slow"})
+	assert.Equal(t, result.NextCursor, "")
+}
+
+func TestSearchGroupsTraces(t *testing.T) {
+	store := sdb.NewMemoryStore()
+	root := span("t1", "a", "GET /cart", 1000, 1000, nil)
+	first := span("t1", "b", "db.query", 1100, 10, nil)
+	first.ParentId = "a"
+	second := span("t1", "c", "db.query", 1500, 10, nil)
+	second.ParentId = "a"
+	storeSpans(store, "checkout", root)
+	storeSpans(store, "db", first, second)
+	storeSpans(store, "db", span("t2", "a", "db.query", 1200, 10, nil))
+	searcher := NewSearcher(store, store, indexedTags)
+
+	result, err := searcher.Search(&Search{Name: "db.query", From: 0, To: 10000, Limit: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, traceIds(result), []string{"t1", "t2"}, "should list traces by their most recent match")
+	trace := result.Traces[0]
+	assert.Equal(t, trace.Name, "GET /cart", "should describe the trace by its root")
+	assert.Equal(t, trace.EntityName, "checkout")
+	assert.Equal(t, trace.StartTime, float64(1000))
+	assert.Equal(t, trace.Duration, float64(1000))
+	assert.Equal(t, trace.SpanCount, 3)
+	assert.Equal(t, len(trace.Matches), 2)
+	assert.Equal(t, trace.Matches[0].SpanId, "c")
+
+	result, _ = searcher.Search(&Search{Name: "db.query", MinDuration: 500, From: 0, To: 10000, Limit: 10})
+	assert.Equal(t, traceIds(result), []string{"t1"}, "should filter on the trace's duration")
+	result, _ = searcher.Search(&Search{Name: "db.query", MaxDuration: 100, From: 0, To: 10000, Limit: 10})
+	assert.Equal(t, traceIds(result), []string{"t2"})
+
+	// t1 matches on both sides of t2
+	search := &Search{Name: "db.query", From: 0, To: 10000, Limit: 1}
+	seen := make([]string, 0)
+	for pages := 0; pages < 5; pages++ {
+		result, err := searcher.Search(search)
+		assert.Nil(t, err)
+		seen = append(seen, traceIds(result)...)
+		if result.NextCursor == "" {
+			break
+		}
+		search.Cursor, _ = DecodeCursor(result.NextCursor)
+	}
+	assert.Equal(t, seen, []string{"t1", "t2"}, "should not list a trace again on a later page")
+}
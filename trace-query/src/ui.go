@@ -0,0 +1,23 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// The trace browser is a single page, built into the binary so the service
+// stays a single file to deploy.
+//
+//go:embed ui
+var uiFiles embed.FS
+
+// UIHandler serves the trace browser. Its pages are picked by the URL
+// fragment, so every other path is left to the API.
+func UIHandler() http.Handler {
+	files, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		panic(err)
+	}
+	return http.FileServer(http.FS(files))
+}
@@ -0,0 +1,441 @@
+'use strict';
+
+// The trace browser. Pages are picked by the URL fragment:
+//   #/?entity=...&name=...   search
+//   #/traces/{trace_id}      a trace's waterfall
+//   #/errors?component=...   errors reported by the services
+
+function $(selector) {
+  return document.querySelector(selector);
+}
+
+function el(tag, attrs, children) {
+  const node = document.createElement(tag);
+  Object.keys(attrs || {}).forEach(function (key) {
+    if (key === 'text') {
+      node.textContent = attrs[key];
+    } else {
+      node.setAttribute(key, attrs[key]);
+    }
+  });
+  (children || []).forEach(function (child) {
+    node.appendChild(child);
+  });
+  return node;
+}
+
+function getJSON(path) {
+  return fetch(path).then(function (res) {
+    return res.json().then(function (body) {
+      if (!res.ok) {
+        throw new Error(body.error || res.statusText);
+      }
+      return body;
+    });
+  });
+}
+
+function showError(node, err) {
+  node.textContent = err ? err.message : '';
+  node.hidden = !err;
+}
+
+function formatDuration(ms) {
+  if (ms >= 1000) {
+    return (ms / 1000).toFixed(2) + 's';
+  }
+  return (Math.round(ms * 100) / 100) + 'ms';
+}
+
+function formatTime(ms) {
+  return new Date(ms).toLocaleString();
+}
+
+// datetime-local inputs are in local time, without a zone
+function toInput(ms) {
+  const d = new Date(ms - new Date(ms).getTimezoneOffset() * 60000);
+  return d.toISOString().slice(0, 16);
+}
+
+function fromInput(value) {
+  return value ? new Date(value).getTime() : '';
+}
+
+function isError(span) {
+  const tags = span.tags || {};
+  return tags.error === true || tags.error === 'true' || Number(tags['http.status_code']) >= 500;
+}
+
+// search
+
+// the search being shown, for fetching more of it
+let lastParams = new URLSearchParams();
+let nextCursor = '';
+
+function searchParams() {
+  const form = $('#search');
+  const params = new URLSearchParams();
+  ['entity', 'name', 'min_duration', 'max_duration'].forEach(function (name) {
+    if (form.elements[name].value) {
+      params.set(name, form.elements[name].value);
+    }
+  });
+  form.elements.tags.value.split(/\s+/).filter(Boolean).forEach(function (tag) {
+    params.append('tag', tag);
+  });
+  ['from', 'to'].forEach(function (name) {
+    const ms = fromInput(form.elements[name].value);
+    if (ms !== '') {
+      params.set(name, ms);
+    }
+  });
+  return params;
+}
+
+function fillSearch(params) {
+  const form = $('#search');
+  const to = Number(params.get('to')) || Date.now();
+  const from = Number(params.get('from')) || to - 3600000;
+  form.elements.entity.value = params.get('entity') || '';
+  form.elements.name.value = params.get('name') || '';
+  form.elements.tags.value = params.getAll('tag').join(' ');
+  form.elements.from.value = toInput(from);
+  form.elements.to.value = toInput(to);
+  form.elements.min_duration.value = params.get('min_duration') || '';
+  form.elements.max_duration.value = params.get('max_duration') || '';
+  loadSpanNames(form.elements.entity.value);
+}
+
+function loadEntities() {
+  return getJSON('/entities').then(function (entities) {
+    const select = $('#search').elements.entity;
+    entities.forEach(function (entity) {
+      select.appendChild(el('option', {value: entity, text: entity}));
+    });
+  });
+}
+
+function loadSpanNames(entity) {
+  const list = $('#span-names');
+  list.textContent = '';
+  if (!entity) {
+    return;
+  }
+  getJSON('/entities/' + encodeURIComponent(entity) + '/span-names').then(function (names) {
+    names.forEach(function (name) {
+      list.appendChild(el('option', {value: name}));
+    });
+  });
+}
+
+function resultRow(trace) {
+  const link = el('a', {href: '#/traces/' + encodeURIComponent(trace.trace_id), text: trace.trace_id});
+  return el('tr', {}, [
+    el('td', {text: formatTime(trace.start_time)}),
+    el('td', {text: trace.entity_name}),
+    el('td', {text: trace.name}),
+    el('td', {class: 'number', text: formatDuration(trace.duration)}),
+    el('td', {class: 'number', text: trace.matches.length + ' of ' + trace.span_count}),
+    el('td', {}, [link]),
+  ]);
+}
+
+function runSearch(params, append) {
+  const table = $('#results');
+  const body = table.querySelector('tbody');
+  if (!append) {
+    body.textContent = '';
+    nextCursor = '';
+    lastParams = params;
+  }
+  if (!params.get('entity') && !params.get('name') && !params.get('tag')) {
+    table.hidden = true;
+    $('#more').hidden = true;
+    return;
+  }
+  if (append) {
+    params.set('cursor', nextCursor);
+  }
+  getJSON('/traces?' + params.toString()).then(function (result) {
+    showError($('#search-error'));
+    result.traces.forEach(function (trace) {
+      body.appendChild(resultRow(trace));
+    });
+    if (!append && result.traces.length === 0) {
+      body.appendChild(el('tr', {}, [el('td', {colspan: 6, text: 'No traces found.'})]));
+    }
+    table.hidden = false;
+    nextCursor = result.next_cursor || '';
+    $('#more').hidden = !nextCursor;
+  }).catch(function (err) {
+    showError($('#search-error'), err);
+  });
+}
+
+// trace
+
+function selectionList(selections) {
+  const list = $('#selections');
+  list.textContent = '';
+  if (!selections.length) {
+    list.appendChild(el('p', {text: 'Not selected.'}));
+    return;
+  }
+  selections.forEach(function (selection) {
+    let text = selection.reason;
+    if (selection.score) {
+      text += ' (score ' + selection.score.toFixed(2) + ')';
+    }
+    if (selection.span_id) {
+      text += ' on ' + selection.span_id;
+    }
+    list.appendChild(el('span', {class: 'reason', title: 'selected ' + formatTime(Date.parse(selection.selected_at)), text: text}));
+  });
+}
+
+function integrityWarnings(integrity) {
+  const node = $('#integrity');
+  node.textContent = '';
+  const problems = [];
+  if (integrity.roots.length !== 1) {
+    problems.push(integrity.roots.length + ' root spans');
+  }
+  [
+    ['orphans', 'spans missing their parent'],
+    ['cycles', 'cycles'],
+    ['duplicate_span_ids', 'duplicate span ids'],
+    ['outside_parent', 'spans outside their parent'],
+    ['foreign_spans', 'spans from other traces'],
+  ].forEach(function (problem) {
+    const found = integrity[problem[0]];
+    if (found && found.length) {
+      problems.push(found.length + ' ' + problem[1]);
+    }
+  });
+  if (problems.length) {
+    node.appendChild(el('p', {class: 'warning', text: 'This trace does not fit together: ' + problems.join(', ') + '.'}));
+  }
+}
+
+function showDetails(span, entity) {
+  const details = $('#details');
+  const body = details.querySelector('tbody');
+  $('#details-title').textContent = span.name;
+  body.textContent = '';
+  const rows = [
+    ['span id', span.span_id],
+    ['parent id', span.parent_id || ''],
+    ['entity', entity],
+    ['started', formatTime(span.start_time)],
+    ['duration', formatDuration(span.finish_time - span.start_time)],
+  ];
+  Object.keys(span.tags || {}).sort().forEach(function (tag) {
+    const value = span.tags[tag];
+    rows.push([tag, typeof value === 'object' ? JSON.stringify(value) : String(value)]);
+  });
+  rows.forEach(function (row) {
+    body.appendChild(el('tr', {}, [el('td', {text: row[0]}), el('td', {text: row[1]})]));
+  });
+  details.hidden = false;
+}
+
+function waterfall(trace) {
+  const node = $('#waterfall');
+  node.textContent = '';
+  let start = Infinity;
+  let finish = -Infinity;
+  const rows = [];
+  const walk = function (n, depth) {
+    start = Math.min(start, n.span.start_time);
+    finish = Math.max(finish, n.span.finish_time);
+    rows.push({span: n.span, depth: depth});
+    (n.children || []).forEach(function (child) {
+      walk(child, depth + 1);
+    });
+  };
+  trace.roots.forEach(function (root) {
+    walk(root, 0);
+  });
+  const total = Math.max(finish - start, 1);
+
+  rows.forEach(function (row) {
+    const span = row.span;
+    const entity = trace.entities[span.span_id] || '';
+    const left = (span.start_time - start) / total * 100;
+    const width = (span.finish_time - span.start_time) / total * 100;
+    const name = el('div', {class: 'name', style: 'padding-left: ' + row.depth * 16 + 'px', title: span.name}, [
+      document.createTextNode(span.name + ' '),
+      el('span', {class: 'entity', text: entity}),
+    ]);
+    const timeline = el('div', {class: 'timeline'}, [
+      el('div', {class: 'bar', style: 'left: ' + left + '%; width: ' + width + '%'}),
+      el('div', {class: 'duration', style: 'left: ' + (left + width) + '%', text: formatDuration(span.finish_time - span.start_time)}),
+    ]);
+    const line = el('div', {class: isError(span) ? 'row error' : 'row'}, [name, timeline]);
+    line.addEventListener('click', function () {
+      node.querySelectorAll('.selected').forEach(function (selected) {
+        selected.classList.remove('selected');
+      });
+      line.classList.add('selected');
+      showDetails(span, entity);
+    });
+    node.appendChild(line);
+  });
+}
+
+function showTrace(traceId) {
+  $('#trace-title').textContent = 'Trace ' + traceId;
+  $('#selections').textContent = '';
+  $('#integrity').textContent = '';
+  $('#waterfall').textContent = '';
+  $('#details').hidden = true;
+  getJSON('/traces/' + encodeURIComponent(traceId)).then(function (trace) {
+    showError($('#trace-error'));
+    selectionList(trace.selections);
+    integrityWarnings(trace.integrity);
+    waterfall(trace);
+  }).catch(function (err) {
+    showError($('#trace-error'), err);
+  });
+}
+
+// errors
+
+function errorFilterParams() {
+  const form = $('#error-filter');
+  const params = new URLSearchParams();
+  ['component', 'event', 'message_id'].forEach(function (name) {
+    if (form.elements[name].value) {
+      params.set(name, form.elements[name].value);
+    }
+  });
+  ['from', 'to'].forEach(function (name) {
+    const ms = fromInput(form.elements[name].value);
+    if (ms !== '') {
+      params.set(name, ms);
+    }
+  });
+  return params;
+}
+
+function fillErrorFilter(params) {
+  const form = $('#error-filter');
+  ['component', 'event', 'message_id'].forEach(function (name) {
+    form.elements[name].value = params.get(name) || '';
+  });
+  const to = Number(params.get('to')) || Date.now();
+  form.elements.from.value = toInput(Number(params.get('from')) || to - 3600000);
+  form.elements.to.value = params.get('to') ? toInput(to) : '';
+}
+
+// errorsLink gives the errors page for params with one of them swapped out
+function errorsLink(params, name, value) {
+  const linked = new URLSearchParams(params);
+  linked.set(name, value);
+  return '#/errors?' + linked.toString();
+}
+
+function errorCounts(params, counts) {
+  const body = $('#error-counts tbody');
+  body.textContent = '';
+  const components = Object.keys(counts).sort(function (a, b) {
+    return counts[b] - counts[a];
+  });
+  if (!components.length) {
+    body.appendChild(el('tr', {}, [el('td', {colspan: 2, text: 'No errors.'})]));
+  }
+  components.forEach(function (component) {
+    body.appendChild(el('tr', {}, [
+      el('td', {}, [el('a', {href: errorsLink(params, 'component', component), text: component})]),
+      el('td', {class: 'number', text: String(counts[component])}),
+    ]));
+  });
+}
+
+function errorRow(params, e) {
+  const message = e.stack ?
+    el('details', {}, [el('summary', {text: e.message}), document.createTextNode(e.stack)]) :
+    document.createTextNode(e.message);
+  const messageId = e.message_id ?
+    el('a', {href: errorsLink(params, 'message_id', e.message_id), title: 'Every error from this message', text: e.message_id}) :
+    document.createTextNode('');
+  return el('tr', {}, [
+    el('td', {text: formatTime(Date.parse(e.timestamp))}),
+    el('td', {text: e.component}),
+    el('td', {text: e.event}),
+    el('td', {}, [message]),
+    el('td', {}, [messageId]),
+  ]);
+}
+
+function showErrors(params) {
+  fillErrorFilter(params);
+  // counts are across every component, to compare them
+  const countParams = new URLSearchParams(params);
+  countParams.delete('component');
+  Promise.all([
+    getJSON('/errors/counts?' + countParams.toString()),
+    getJSON('/errors?' + params.toString()),
+  ]).then(function (results) {
+    showError($('#errors-error'));
+    errorCounts(params, results[0]);
+    const body = $('#errors tbody');
+    body.textContent = '';
+    results[1].forEach(function (e) {
+      body.appendChild(errorRow(params, e));
+    });
+  }).catch(function (err) {
+    showError($('#errors-error'), err);
+  });
+}
+
+// routing
+
+function route() {
+  const hash = location.hash.replace(/^#/, '') || '/';
+  const trace = hash.match(/^\/traces\/(.+)$/);
+  const errors = /^\/errors(\?|$)/.test(hash);
+  $('#trace-page').hidden = !trace;
+  $('#errors-page').hidden = !errors;
+  $('#search-page').hidden = !!trace || errors;
+  const params = new URLSearchParams(hash.split('?')[1] || '');
+  if (trace) {
+    showTrace(decodeURIComponent(trace[1]));
+    return;
+  }
+  if (errors) {
+    showErrors(params);
+    return;
+  }
+  fillSearch(params);
+  runSearch(params, false);
+}
+
+$('#search').addEventListener('submit', function (e) {
+  e.preventDefault();
+  location.hash = '#/?' + searchParams().toString();
+});
+
+$('#search').elements.entity.addEventListener('change', function (e) {
+  loadSpanNames(e.target.value);
+});
+
+$('#error-filter').addEventListener('submit', function (e) {
+  e.preventDefault();
+  location.hash = '#/errors?' + errorFilterParams().toString();
+});
+
+$('#more').addEventListener('click', function () {
+  runSearch(new URLSearchParams(lastParams), true);
+});
+
+$('#open-trace').addEventListener('submit', function (e) {
+  e.preventDefault();
+  const traceId = e.target.elements.trace_id.value.trim();
+  if (traceId) {
+    location.hash = '#/traces/' + encodeURIComponent(traceId);
+  }
+});
+
+window.addEventListener('hashchange', route);
+loadEntities().catch(function () {}).then(route);
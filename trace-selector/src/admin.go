@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	sdb "shared/db"
+	st "shared/types"
+
+	"github.com/gorilla/mux"
+	"github.com/satori/go.uuid"
+)
+
+// AdminServer lets people force traces to be exported, e.g. while looking
+// into a customer's problem.
+type AdminServer struct {
+	selections      sdb.TraceSelectionStore
+	spans           sdb.SpanStore
+	selectionWriter SelectionWriter
+	retention       *sdb.RetentionPolicy
+	pins            *TagPins
+	missingLicenses *EntityCounter
+}
+
+type TracePinResponse struct {
+	TraceId     string `json:"trace_id"`
+	Pinned      bool   `json:"pinned"`
+	SpansStored int    `json:"spans_stored"`
+}
+
+type TagPinRequest struct {
+	Tag     string `json:"tag"`
+	Value   string `json:"value"`
+	Minutes int    `json:"minutes"`
+}
+
+func NewAdminServer(selections sdb.TraceSelectionStore, spans sdb.SpanStore, selectionWriter SelectionWriter, retention *sdb.RetentionPolicy, pins *TagPins, missingLicenses *EntityCounter) *AdminServer {
+	return &AdminServer{
+		selections:      selections,
+		spans:           spans,
+		selectionWriter: selectionWriter,
+		retention:       retention,
+		pins:            pins,
+		missingLicenses: missingLicenses,
+	}
+}
+
+func (a *AdminServer) Router() *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/pins/traces/{traceId}", a.getTracePin).Methods("GET")
+	r.HandleFunc("/pins/traces/{traceId}", a.pinTrace).Methods("PUT")
+	r.HandleFunc("/pins/traces/{traceId}", a.unpinTrace).Methods("DELETE")
+	r.HandleFunc("/pins/tags", a.listTagPins).Methods("GET")
+	r.HandleFunc("/pins/tags", a.pinTag).Methods("POST")
+	r.HandleFunc("/pins/tags/{id}", a.unpinTag).Methods("DELETE")
+	r.HandleFunc("/stats/missing-license-keys", a.getMissingLicenseKeys).Methods("GET")
+	return r
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Print(err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func (a *AdminServer) tracePinStatus(traceId string) (*TracePinResponse, error) {
+	res := &TracePinResponse{TraceId: traceId}
+	pinned, err := a.selections.HasSelection(traceId, "manual")
+	if err != nil {
+		return nil, err
+	}
+	res.Pinned = pinned
+	res.SpansStored, err = a.spans.CountSpans(traceId)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (a *AdminServer) getTracePin(w http.ResponseWriter, r *http.Request) {
+	res, err := a.tracePinStatus(mux.Vars(r)["traceId"])
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (a *AdminServer) pinTrace(w http.ResponseWriter, r *http.Request) {
+	trace := st.NewInterestingTrace(mux.Vars(r)["traceId"], "manual")
+	if err := a.selections.SaveSelections([]*st.InterestingTrace{trace}, a.retention.TTL("")); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := a.selectionWriter.Write(st.NewTraceSelection(*trace, "")); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	log.Printf("pinned trace %s", trace.TraceId)
+	res, err := a.tracePinStatus(trace.TraceId)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// unpinTrace only drops the manual selection, spans that have already been
+// exported stay exported, and other reasons for selecting the trace stand.
+func (a *AdminServer) unpinTrace(w http.ResponseWriter, r *http.Request) {
+	traceId := mux.Vars(r)["traceId"]
+	if err := a.selections.DeleteSelection(traceId, "manual"); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	log.Printf("unpinned trace %s", traceId)
+	res, err := a.tracePinStatus(traceId)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (a *AdminServer) listTagPins(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.pins.Active(time.Now()))
+}
+
+func (a *AdminServer) pinTag(w http.ResponseWriter, r *http.Request) {
+	var req TagPinRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Tag == "" || req.Minutes <= 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "tag and a positive number of minutes are required"})
+		return
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	pin := &TagPin{
+		Id:        id.String(),
+		Tag:       req.Tag,
+		Value:     req.Value,
+		ExpiresAt: time.Now().Add(time.Duration(req.Minutes) * time.Minute),
+	}
+	a.pins.Add(pin)
+	log.Printf("pinned traces with %s=%s until %s", pin.Tag, pin.Value, pin.ExpiresAt)
+	writeJSON(w, http.StatusCreated, pin)
+}
+
+func (a *AdminServer) unpinTag(w http.ResponseWriter, r *http.Request) {
+	if !a.pins.Remove(mux.Vars(r)["id"]) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no such pin"})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getMissingLicenseKeys reports, per entity, how many selected traces came in
+// without a license key.
+func (a *AdminServer) getMissingLicenseKeys(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.missingLicenses.Counts())
+}
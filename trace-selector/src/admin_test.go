@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	sdb "shared/db"
+	st "shared/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func request(t *testing.T, admin *AdminServer, method string, path string) (int, *TracePinResponse) {
+	rec := httptest.NewRecorder()
+	admin.Router().ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+	res := &TracePinResponse{}
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), res))
+	return rec.Code, res
+}
+
+func TestPinTrace(t *testing.T) {
+	store := sdb.NewMemoryStore()
+	store.WriteSpans([]st.SpanRow{
+		{SpanRecord: st.SpanRecord{TraceId: "t1", SpanId: "a"}},
+		{SpanRecord: st.SpanRecord{TraceId: "t1", SpanId: "b"}},
+	}, 60)
+	writer := &testSelectionWriter{}
+	admin := NewAdminServer(store, store, writer, &sdb.RetentionPolicy{}, NewTagPins(), NewEntityCounter())
+
+	code, res := request(t, admin, "GET", "/pins/traces/t1")
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, *res, TracePinResponse{TraceId: "t1", Pinned: false, SpansStored: 2})
+
+	code, res = request(t, admin, "PUT", "/pins/traces/t1")
+	assert.Equal(t, code, http.StatusOK)
+	assert.True(t, res.Pinned)
+	assert.Equal(t, len(writer.selections), 1, "should let the processors know")
+	assert.Equal(t, writer.selections[0].Reason, "manual")
+
+	store.SaveSelections([]*st.InterestingTrace{st.NewInterestingTrace("t1", "error")}, 60)
+	code, res = request(t, admin, "DELETE", "/pins/traces/t1")
+	assert.Equal(t, code, http.StatusOK)
+	assert.False(t, res.Pinned)
+	stillSelected, _ := store.HasSelection("t1", "error")
+	assert.True(t, stillSelected, "should only drop the manual selection")
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"sync"
+)
+
+// EntityCounter counts occurrences of something per entity.
+type EntityCounter struct {
+	lock   sync.Mutex
+	counts map[string]int
+}
+
+func NewEntityCounter() *EntityCounter {
+	return &EntityCounter{
+		counts: make(map[string]int),
+	}
+}
+
+func (c *EntityCounter) Add(entityName string, n int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.counts[entityName] += n
+}
+
+// Counts gives a copy of the counts so far.
+func (c *EntityCounter) Counts() map[string]int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	counts := make(map[string]int, len(c.counts))
+	for entityName, count := range c.counts {
+		counts[entityName] = count
+	}
+	return counts
+}
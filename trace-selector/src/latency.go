@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	st "shared/types"
+)
+
+// ewma tracks an exponentially weighted mean and variance of span durations.
+type ewma struct {
+	mean     float64
+	variance float64
+	samples  int
+	lastSeen time.Time
+}
+
+func (e *ewma) add(x float64, alpha float64) {
+	if e.samples == 0 {
+		e.mean = x
+		e.samples++
+		return
+	}
+	diff := x - e.mean
+	incr := alpha * diff
+	e.mean += incr
+	e.variance = (1 - alpha) * (e.variance + diff*incr)
+	e.samples++
+}
+
+// LatencyBaselines keeps a streaming latency baseline for every span name of
+// every entity, and scores spans by how many standard deviations slower than
+// their baseline they are.
+type LatencyBaselines struct {
+	// weight given to each new duration
+	Alpha float64
+	// z-score a span needs to count as an outlier
+	Threshold float64
+	// how many spans a baseline needs before anything is scored against it
+	MinSamples int
+	// most baselines kept at once, spans that would need a new baseline past
+	// this aren't scored. 0 removes the limit
+	MaxBaselines int
+	// baselines that haven't seen a span for this long are dropped. 0 keeps
+	// them forever
+	IdleTTL   time.Duration
+	baselines map[string]*ewma
+	swept     time.Time
+}
+
+func NewLatencyBaselines(alpha float64, threshold float64, minSamples int, maxBaselines int, idleTTL time.Duration) (*LatencyBaselines, error) {
+	if alpha <= 0 || alpha > 1 {
+		return nil, fmt.Errorf("latency alpha must be in (0, 1], got %v", alpha)
+	}
+	if threshold <= 0 {
+		return nil, fmt.Errorf("latency z-score must be positive, got %v", threshold)
+	}
+	return &LatencyBaselines{
+		Alpha:        alpha,
+		Threshold:    threshold,
+		MinSamples:   minSamples,
+		MaxBaselines: maxBaselines,
+		IdleTTL:      idleTTL,
+		baselines:    make(map[string]*ewma),
+	}, nil
+}
+
+// Score gives the span's z-score against its baseline, and whether it is an
+// outlier, then adds it to the baseline.
+func (lb *LatencyBaselines) Score(entityName string, s *st.Span, now time.Time) (float64, bool) {
+	// sweeping once per IdleTTL keeps baselines at most twice the TTL old
+	if lb.IdleTTL > 0 && now.Sub(lb.swept) >= lb.IdleTTL {
+		lb.evictIdle(now)
+	}
+	key := entityName + "\x00" + s.Name
+	baseline, ok := lb.baselines[key]
+	if !ok {
+		if lb.MaxBaselines > 0 && len(lb.baselines) >= lb.MaxBaselines {
+			return 0, false
+		}
+		baseline = &ewma{}
+		lb.baselines[key] = baseline
+	}
+	baseline.lastSeen = now
+	duration := s.FinishTime - s.StartTime
+
+	score := 0.0
+	if baseline.samples >= lb.MinSamples && baseline.variance > 0 {
+		score = (duration - baseline.mean) / math.Sqrt(baseline.variance)
+	}
+	baseline.add(duration, lb.Alpha)
+	return score, score >= lb.Threshold
+}
+
+func (lb *LatencyBaselines) evictIdle(now time.Time) {
+	for key, baseline := range lb.baselines {
+		if now.Sub(baseline.lastSeen) >= lb.IdleTTL {
+			delete(lb.baselines, key)
+		}
+	}
+	lb.swept = now
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	st "shared/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func spanWithDuration(name string, duration float64) *st.Span {
+	return &st.Span{
+		Name:       name,
+		StartTime:  1549128157237,
+		FinishTime: 1549128157237 + duration,
+	}
+}
+
+func TestLatencyBaselinesScore(t *testing.T) {
+	lb, err := NewLatencyBaselines(0.05, 3, 30, 0, 0)
+	assert.Nil(t, err)
+	now := time.Now()
+	rng := rand.New(rand.NewSource(1))
+
+	_, outlier := lb.Score("checkout", spanWithDuration("/cart", 5000), now)
+	assert.False(t, outlier, "should not score until there is a baseline")
+
+	for i := 0; i < 500; i++ {
+		lb.Score("checkout", spanWithDuration("/cart", 100+rng.NormFloat64()*10), now)
+	}
+	score, outlier := lb.Score("checkout", spanWithDuration("/cart", 105), now)
+	assert.False(t, outlier, "should not flag normal spans")
+	assert.True(t, score < 3)
+
+	score, outlier = lb.Score("checkout", spanWithDuration("/cart", 300), now)
+	assert.True(t, outlier, "should flag slow spans")
+	assert.True(t, score > 10, "should score by standard deviations")
+
+	_, outlier = lb.Score("search", spanWithDuration("/cart", 300), now)
+	assert.False(t, outlier, "should keep baselines per entity")
+	_, outlier = lb.Score("checkout", spanWithDuration("/checkout", 300), now)
+	assert.False(t, outlier, "should keep baselines per span name")
+}
+
+func TestLatencyBaselinesLimits(t *testing.T) {
+	lb, err := NewLatencyBaselines(0.05, 3, 1, 2, time.Hour)
+	assert.Nil(t, err)
+	now := time.Now()
+	lb.Score("checkout", spanWithDuration("/cart", 100), now)
+	lb.Score("checkout", spanWithDuration("/checkout", 100), now)
+	lb.Score("checkout", spanWithDuration("/search", 100), now)
+	assert.Equal(t, len(lb.baselines), 2, "should stop adding baselines at the limit")
+
+	lb.Score("checkout", spanWithDuration("/cart", 100), now.Add(45*time.Minute))
+	lb.Score("checkout", spanWithDuration("/search", 100), now.Add(90*time.Minute))
+	_, ok := lb.baselines["checkout\x00/checkout"]
+	assert.False(t, ok, "should drop idle baselines")
+	assert.Equal(t, len(lb.baselines), 2)
+}
+
+func TestNewLatencyBaselines(t *testing.T) {
+	_, err := NewLatencyBaselines(0.05, 0, 30, 0, 0)
+	assert.NotNil(t, err, "should need a positive z-score")
+	_, err = NewLatencyBaselines(0.05, -1, 30, 0, 0)
+	assert.NotNil(t, err)
+	_, err = NewLatencyBaselines(0, 3, 30, 0, 0)
+	assert.NotNil(t, err, "should need an alpha that moves the baseline")
+}
@@ -2,33 +2,42 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	sc "shared/config"
 	sdb "shared/db"
 	sm "shared/message"
 	st "shared/types"
 
-	"github.com/gocql/gocql"
 	"github.com/segmentio/kafka-go"
 )
 
-var KEYSPACE string = "span_collector"
-var TABLE_NAME string = KEYSPACE + ".interesting_traces"
-
-// TODO: include reason for selection
-type InterestingTrace struct {
-	TraceId string `cassandra: "trace_id"`
+// SelectionWriter lets the span processors know about selected traces.
+type SelectionWriter interface {
+	Write(selections ...*st.TraceSelection) error
 }
 
-func isInteresting(s *st.Span) bool {
-	// just check if it has an error for now
-	_, ok := s.Tags["error"]
-	return ok
+// parseInterestingTrace reads a message off the interestingTraces topic.
+// Older producers send just the trace id.
+func parseInterestingTrace(value []byte) *st.InterestingTrace {
+	trace := st.NewInterestingTrace("", "anomaly")
+	if err := json.Unmarshal(value, trace); err != nil || trace.TraceId == "" {
+		return st.NewInterestingTrace(string(value), "anomaly")
+	}
+	if trace.Reason == "" {
+		trace.Reason = "anomaly"
+	}
+	return trace
 }
 
-func startTraceMessageConsumer(session *gocql.Session) {
+func startTraceMessageConsumer(store sdb.TraceSelectionStore, selectionWriter SelectionWriter, retention *sdb.RetentionPolicy) {
 	r := kafka.NewReader(kafka.ReaderConfig{
 		Brokers:   []string{"kafka:9092"},
 		GroupID:   "traceConsumers",
@@ -42,80 +51,239 @@ func startTraceMessageConsumer(session *gocql.Session) {
 			fmt.Printf("Consumer error: %v (%v)\n", err, m)
 			log.Fatal("dying")
 		}
-		traceId := string(m.Value)
-		log.Print("got an interesting trace ", traceId)
-		err = session.Query("INSERT into "+TABLE_NAME+" (trace_id) VALUES (?);", traceId).Exec()
+		trace := parseInterestingTrace(m.Value)
+		log.Printf("got an interesting trace %s (%s, score %f)", trace.TraceId, trace.Reason, trace.Score)
+		err = store.SaveSelections([]*st.InterestingTrace{trace}, retention.TTL(trace.EntityName))
 		if err != nil {
 			fmt.Printf("Consumer error (on insert): %v\n", err)
 			log.Fatal("dying")
 		}
+		if err := selectionWriter.Write(st.NewTraceSelection(*trace, "")); err != nil {
+			log.Print("could not publish trace selection: ", err)
+		}
+	}
+}
+
+// recordSelections writes a batch of interesting traces and, once they are
+// stored, lets the span processors know they can export them.
+func recordSelections(store sdb.TraceSelectionStore, traces []*st.InterestingTrace, ttl int, messageId *string, selectionWriter SelectionWriter, errHandler sm.ErrorReporter) {
+	if len(traces) == 0 {
+		return
+	}
+	err := store.SaveSelections(traces, ttl)
+	if err != nil {
+		log.Print(err)
+		errHandler.HandleErr(
+			messageId,
+			err,
+			"insert",
+		)
+		return
+	}
+	selections := make([]*st.TraceSelection, len(traces))
+	for i, trace := range traces {
+		selections[i] = st.NewTraceSelection(*trace, *messageId)
+	}
+	if err := selectionWriter.Write(selections...); err != nil {
+		log.Print(err)
+		errHandler.HandleErr(
+			messageId,
+			err,
+			"publish",
+		)
+	}
+}
+
+// recordInterestingTraces stores traces in batches, publishing selections for
+// every batch that makes it.
+func recordInterestingTraces(store sdb.TraceSelectionStore, traces []*st.InterestingTrace, ttl int, messageId *string, selectionWriter SelectionWriter, errHandler sm.ErrorReporter) {
+	batchTraces := make([]*st.InterestingTrace, 0)
+	for _, trace := range traces {
+		batchTraces = append(batchTraces, trace)
+		if len(batchTraces) >= 10 {
+			recordSelections(store, batchTraces, ttl, messageId, selectionWriter, errHandler)
+			batchTraces = make([]*st.InterestingTrace, 0)
+		}
+	}
+	recordSelections(store, batchTraces, ttl, messageId, selectionWriter, errHandler)
+}
+
+// recordSampled records the traces the sampler kept. Interesting traces that
+// came in without a license key are counted, and any trace without one is
+// dropped if there's nowhere to send it.
+func recordSampled(store sdb.TraceSelectionStore, sampled []*SampledTrace, retention *sdb.RetentionPolicy, selectionWriter SelectionWriter, errHandler sm.ErrorReporter, missingLicenseKeys *EntityCounter) {
+	for _, t := range sampled {
+		if t.MissingLicenseKey {
+			if !t.Baseline {
+				missingLicenseKeys.Add(t.EntityName, 1)
+			}
+			if t.LicenseKey == "" {
+				continue
+			}
+		}
+		recordInterestingTraces(store, t.Reasons, retention.TTL(t.EntityName), &t.MessageId, selectionWriter, errHandler)
 	}
 }
 
 func main() {
-	//setup cassandra
-	// TODO: make this less awful (e.g. do proper migrations)
-	// TODO?: tie this to the cassandra tags on the struct we are using
-	// to interface with this thing
-	tableSchema := map[string]string{
-		"trace_id": "text",
+	openStore, err := sdb.BackendFromEnv()
+	if err != nil {
+		log.Fatal(err)
 	}
-	session, err := sdb.SetupCassandraSchema(KEYSPACE, TABLE_NAME, tableSchema, "trace_id")
+	store, err := openStore()
 	for err != nil {
-		log.Print("ran into an error while setting up cassandra, waiting 5 seconds: ", err)
+		log.Print("ran into an error while opening the store, waiting 5 seconds: ", err)
 		time.Sleep(5 * time.Second)
-		session, err = sdb.SetupCassandraSchema(KEYSPACE, TABLE_NAME, tableSchema, "trace_id")
+		store, err = openStore()
 	}
-	defer session.Close()
+	defer store.Close()
 
 	//read from kafka
 	reader := sm.NewSpanMessageConsumer("trace-selectors")
 	msgChan := make(chan st.SpanMessage)
 	reader.Start(msgChan)
 
-	go startTraceMessageConsumer(session)
+	retention := sdb.NewRetentionPolicyFromEnv()
+	selectionWriter := sm.NewTraceSelectionProducer()
+	go startTraceMessageConsumer(store, selectionWriter, retention)
 
 	errHandler := sm.NewErrorHandler("trace-selector")
 
+	// rules are swapped out whenever the config changes
+	var rules atomic.Value
+	loadRules := func(path string) error {
+		rs, err := LoadRules(path)
+		if err != nil {
+			return err
+		}
+		rules.Store(rs)
+		return nil
+	}
+	rulesPath := sc.String("RULES_CONFIG", "/conf/rules.json")
+	if err := loadRules(rulesPath); err != nil {
+		log.Fatal(err)
+	}
+	rulesWatcher := sc.NewWatcher(rulesPath, sc.Duration("CONFIG_POLL_INTERVAL", 10*time.Second), loadRules, func(err error) {
+		noMessage := ""
+		errHandler.HandleErr(&noMessage, err, "reload")
+	})
+	go rulesWatcher.Start()
+
+	// selected traces that came in without a license key
+	missingLicenseKeys := NewEntityCounter()
+	defaultLicenseKey := sc.String("DEFAULT_LICENSE_KEY", "")
+
+	sampler := NewSampler(
+		sc.Int("TRACE_BUDGET_PER_ENTITY", 100),
+		sc.Int("TRACE_BUDGET_PER_LICENSE_KEY", 1000),
+		sc.Int("BASELINE_TRACES_PER_ENTITY", 5),
+	)
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			recordSampled(store, sampler.Flush(), retention, selectionWriter, errHandler, missingLicenseKeys)
+		}
+	}()
+
+	latency, err := NewLatencyBaselines(
+		sc.Float("LATENCY_EWMA_ALPHA", 0.05),
+		sc.Float("LATENCY_Z_SCORE", 3),
+		sc.Int("LATENCY_MIN_SAMPLES", 30),
+		sc.Int("LATENCY_MAX_BASELINES", 100000),
+		sc.Duration("LATENCY_BASELINE_TTL", 24*time.Hour),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	pins := NewTagPins()
+	admin := NewAdminServer(store, store, selectionWriter, retention, pins, missingLicenseKeys)
+	go func() {
+		// the admin API has no auth, so only listen locally unless told to
+		addr := sc.String("ADMIN_ADDR", "127.0.0.1:12346")
+		log.Print("Admin API listening on ", addr)
+		log.Fatal(http.ListenAndServe(addr, admin.Router()))
+	}()
+
 	for msg := range msgChan {
-		interestingTraces := make(map[string]bool)
+		// trace id -> the reasons it was selected for
+		traces := make(map[string]*SampledTrace)
+		// pinned traces skip sampling
+		pinned := make(map[string]*st.InterestingTrace)
+		ruleSet := rules.Load().(*RuleSet)
 		for _, span := range msg.Spans {
-			if isInteresting(&span) {
-				if msg.LicenseKey == "" {
-					// TODO: mark this as an error. there will be no way to send this without
-					// the right credentials
-					continue
+			if _, ok := pinned[span.TraceId]; !ok {
+				if _, ok := pins.Match(&span, time.Now()); ok {
+					trace := st.NewInterestingTrace(span.TraceId, "manual")
+					trace.SpanId = span.SpanId
+					trace.EntityName = msg.EntityName
+					pinned[span.TraceId] = trace
 				}
-				interestingTraces[span.TraceId] = true
 			}
-		}
-		if len(interestingTraces) > 0 {
-			batch := gocql.NewBatch(gocql.LoggedBatch)
-			for traceId, _ := range interestingTraces {
-				batch.Query("INSERT into "+TABLE_NAME+"(trace_id) VALUES (?);", traceId)
-				if batch.Size() >= 10 {
-					err := session.ExecuteBatch(batch)
-					if err != nil {
-						log.Print(err)
-						errHandler.HandleErr(
-							&msg.MessageId,
-							err,
-							"insert",
-						)
-					}
-					batch = gocql.NewBatch(gocql.LoggedBatch)
+
+			t, ok := traces[span.TraceId]
+			if !ok {
+				t = &SampledTrace{
+					TraceId:    span.TraceId,
+					EntityName: msg.EntityName,
+					LicenseKey: msg.LicenseKey,
+					MessageId:  msg.MessageId,
+					Reasons:    make([]*st.InterestingTrace, 0),
 				}
+				traces[span.TraceId] = t
+			}
+			reasons := make([]*st.InterestingTrace, 0)
+			for _, reason := range ruleSet.Match(msg.EntityName, &span) {
+				trace := st.NewInterestingTrace(span.TraceId, reason)
+				trace.SpanId = span.SpanId
+				trace.EntityName = msg.EntityName
+				reasons = append(reasons, trace)
+			}
+			if score, outlier := latency.Score(msg.EntityName, &span, time.Now()); outlier {
+				trace := st.NewInterestingTrace(span.TraceId, "latency")
+				trace.SpanId = span.SpanId
+				trace.EntityName = msg.EntityName
+				trace.Score = score
+				reasons = append(reasons, trace)
 			}
+			t.mergeReasons(reasons)
+		}
 
-			err := session.ExecuteBatch(batch)
-			if err != nil {
-				log.Print(err)
+		if msg.LicenseKey == "" {
+			// there will be no way to send these without the right
+			// credentials, unless they can go to the default destination.
+			// Interesting traces are counted once they're selected, pinned
+			// ones straight away
+			missing := make([]string, 0)
+			for traceId, t := range traces {
+				t.LicenseKey = defaultLicenseKey
+				t.MissingLicenseKey = true
+				if _, isPinned := pinned[traceId]; len(t.Reasons) > 0 || isPinned {
+					missing = append(missing, traceId)
+				}
+			}
+			if len(missing) > 0 {
+				sort.Strings(missing)
 				errHandler.HandleErr(
 					&msg.MessageId,
-					err,
-					"insert",
+					fmt.Errorf("traces %s from entity %s are interesting but have no license key", strings.Join(missing, ", "), msg.EntityName),
+					"missing_license_key",
 				)
 			}
+			missingLicenseKeys.Add(msg.EntityName, len(pinned))
+		}
+
+		for traceId, t := range traces {
+			if _, isPinned := pinned[traceId]; !isPinned {
+				sampler.Offer(t)
+			}
+		}
+		if len(pinned) > 0 && (msg.LicenseKey != "" || defaultLicenseKey != "") {
+			pinnedTraces := make([]*st.InterestingTrace, 0, len(pinned))
+			for _, trace := range pinned {
+				pinnedTraces = append(pinnedTraces, trace)
+			}
+			recordInterestingTraces(store, pinnedTraces, retention.TTL(msg.EntityName), &msg.MessageId, selectionWriter, errHandler)
 		}
 	}
 }
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	sdb "shared/db"
+	st "shared/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testSelectionWriter struct {
+	selections []*st.TraceSelection
+	writes     int
+}
+
+func (w *testSelectionWriter) Write(selections ...*st.TraceSelection) error {
+	w.selections = append(w.selections, selections...)
+	w.writes++
+	return nil
+}
+
+type testErrorReporter struct {
+	events []string
+}
+
+func (r *testErrorReporter) HandleErr(messageId *string, err error, event string) {
+	r.events = append(r.events, event)
+}
+
+type failingSelectionStore struct {
+	*sdb.MemoryStore
+}
+
+func (f failingSelectionStore) SaveSelections(traces []*st.InterestingTrace, ttl int) error {
+	return errors.New("cassandra is down")
+}
+
+func TestRecordInterestingTraces(t *testing.T) {
+	store := sdb.NewMemoryStore()
+	writer := &testSelectionWriter{}
+	reporter := &testErrorReporter{}
+	traces := make([]*st.InterestingTrace, 0)
+	for i := 0; i < 15; i++ {
+		traces = append(traces, st.NewInterestingTrace(fmt.Sprintf("t%d", i), "error"))
+	}
+	messageId := "m1"
+	recordInterestingTraces(store, traces, 60, &messageId, writer, reporter)
+
+	selections, _ := store.Selections()
+	assert.Equal(t, len(selections), 15)
+	assert.Equal(t, len(writer.selections), 15, "should publish every stored trace")
+	assert.Equal(t, writer.selections[0].MessageId, "m1")
+	assert.Equal(t, writer.writes, 2, "should publish a batch at a time")
+	assert.Empty(t, reporter.events)
+
+	writer = &testSelectionWriter{}
+	recordInterestingTraces(failingSelectionStore{store}, traces, 60, &messageId, writer, reporter)
+	assert.Empty(t, writer.selections, "should not publish traces that weren't stored")
+	assert.Equal(t, reporter.events, []string{"insert", "insert"}, "should report each failed batch")
+}
+
+func TestRecordSampled(t *testing.T) {
+	store := sdb.NewMemoryStore()
+	writer := &testSelectionWriter{}
+	missing := NewEntityCounter()
+	sampled := []*SampledTrace{
+		sampledTrace("a", "checkout", "key", "error"),
+		sampledTrace("b", "checkout", "", "error"),
+		sampledTrace("c", "checkout", "default", "error"),
+		sampledTrace("d", "checkout", "default", "baseline"),
+	}
+	sampled[1].MissingLicenseKey = true
+	sampled[2].MissingLicenseKey = true
+	sampled[3].MissingLicenseKey = true
+	sampled[3].Baseline = true
+	recordSampled(store, sampled, &sdb.RetentionPolicy{}, writer, &testErrorReporter{}, missing)
+
+	assert.Equal(t, missing.Counts(), map[string]int{"checkout": 2}, "should only count interesting traces without a license key")
+	selections, _ := store.Selections()
+	traceIds := make([]string, 0)
+	for _, selection := range selections {
+		traceIds = append(traceIds, selection.TraceId)
+	}
+	assert.ElementsMatch(t, traceIds, []string{"a", "c", "d"}, "should drop traces with nowhere to go")
+}
+
+func TestParseInterestingTrace(t *testing.T) {
+	trace := parseInterestingTrace([]byte(`{"trace_id": "t1", "span_id": "a", "score": 4.5}`))
+	assert.Equal(t, trace.TraceId, "t1")
+	assert.Equal(t, trace.Reason, "anomaly", "should default the reason")
+	assert.Equal(t, trace.Score, 4.5)
+
+	trace = parseInterestingTrace([]byte("t2"))
+	assert.Equal(t, trace.TraceId, "t2", "should accept a bare trace id")
+	assert.Equal(t, trace.Reason, "anomaly")
+}
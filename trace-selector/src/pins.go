@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	st "shared/types"
+)
+
+// TagPin forces selection of every trace with a span carrying the tag, until
+// it expires.
+type TagPin struct {
+	Id        string    `json:"id"`
+	Tag       string    `json:"tag"`
+	Value     string    `json:"value"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (p *TagPin) Matches(s *st.Span) bool {
+	val, ok := s.Tags[p.Tag]
+	return ok && fmt.Sprint(val) == p.Value
+}
+
+type TagPins struct {
+	lock sync.RWMutex
+	pins map[string]*TagPin
+}
+
+func NewTagPins() *TagPins {
+	return &TagPins{
+		pins: make(map[string]*TagPin),
+	}
+}
+
+func (tp *TagPins) Add(pin *TagPin) {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	tp.pins[pin.Id] = pin
+}
+
+func (tp *TagPins) Remove(id string) bool {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	_, ok := tp.pins[id]
+	delete(tp.pins, id)
+	return ok
+}
+
+// Active gives the pins that haven't expired yet, dropping any that have.
+func (tp *TagPins) Active(now time.Time) []*TagPin {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	active := make([]*TagPin, 0, len(tp.pins))
+	for id, pin := range tp.pins {
+		if now.After(pin.ExpiresAt) {
+			delete(tp.pins, id)
+			continue
+		}
+		active = append(active, pin)
+	}
+	return active
+}
+
+// Match gives the first active pin the span matches.
+func (tp *TagPins) Match(s *st.Span, now time.Time) (*TagPin, bool) {
+	tp.lock.RLock()
+	defer tp.lock.RUnlock()
+	for _, pin := range tp.pins {
+		if now.Before(pin.ExpiresAt) && pin.Matches(s) {
+			return pin, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+
+	st "shared/types"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Rule selects any trace containing a span that matches it. The rule name is
+// recorded as the reason the trace was selected.
+type Rule struct {
+	Name  string    `json:"name" yaml:"name"`
+	Match Predicate `json:"match" yaml:"match"`
+}
+
+// Predicate is a single condition on a span. Exactly one field should be
+// set, conditions are combined with All and Any.
+type Predicate struct {
+	All        []Predicate  `json:"all,omitempty" yaml:"all,omitempty"`
+	Any        []Predicate  `json:"any,omitempty" yaml:"any,omitempty"`
+	Name       *StringMatch `json:"name,omitempty" yaml:"name,omitempty"`
+	Entity     *StringMatch `json:"entity,omitempty" yaml:"entity,omitempty"`
+	Tag        *TagMatch    `json:"tag,omitempty" yaml:"tag,omitempty"`
+	Duration   *NumberMatch `json:"duration,omitempty" yaml:"duration,omitempty"`
+	HttpStatus *NumberMatch `json:"http_status,omitempty" yaml:"http_status,omitempty"`
+}
+
+type StringMatch struct {
+	Equals string `json:"equals,omitempty" yaml:"equals,omitempty"`
+	Regex  string `json:"regex,omitempty" yaml:"regex,omitempty"`
+	regex  *regexp.Regexp
+}
+
+// NumberMatch checks a number against every bound that is set.
+type NumberMatch struct {
+	Gt  *float64 `json:"gt,omitempty" yaml:"gt,omitempty"`
+	Gte *float64 `json:"gte,omitempty" yaml:"gte,omitempty"`
+	Lt  *float64 `json:"lt,omitempty" yaml:"lt,omitempty"`
+	Lte *float64 `json:"lte,omitempty" yaml:"lte,omitempty"`
+}
+
+// TagMatch checks that a tag is present, and optionally what its value is.
+type TagMatch struct {
+	Key         string      `json:"key" yaml:"key"`
+	Equals      interface{} `json:"equals,omitempty" yaml:"equals,omitempty"`
+	Regex       string      `json:"regex,omitempty" yaml:"regex,omitempty"`
+	NumberMatch `yaml:",inline"`
+	regex       *regexp.Regexp
+}
+
+type RuleSet struct {
+	Rules []Rule
+}
+
+// LoadRules reads rules from a JSON or YAML file (picked by extension) and
+// compiles them.
+func LoadRules(path string) (*RuleSet, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]Rule, 0)
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(raw, &rules)
+	default:
+		err = json.Unmarshal(raw, &rules)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewRuleSet(rules)
+}
+
+// NewRuleSet validates the rules and compiles any regexes in them.
+func NewRuleSet(rules []Rule) (*RuleSet, error) {
+	names := make(map[string]bool)
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Name == "" {
+			return nil, fmt.Errorf("rule %d has no name", i)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("rule %s is defined more than once", rule.Name)
+		}
+		names[rule.Name] = true
+		if err := rule.Match.compile(); err != nil {
+			return nil, fmt.Errorf("rule %s: %s", rule.Name, err)
+		}
+	}
+	return &RuleSet{Rules: rules}, nil
+}
+
+// Match gives the names of every rule the span matches.
+func (rs *RuleSet) Match(entityName string, s *st.Span) []string {
+	matches := make([]string, 0)
+	for _, rule := range rs.Rules {
+		if rule.Match.Matches(entityName, s) {
+			matches = append(matches, rule.Name)
+		}
+	}
+	return matches
+}
+
+func (p *Predicate) compile() error {
+	conditions := 0
+	if p.All != nil {
+		conditions++
+		if len(p.All) == 0 {
+			return errors.New("all needs at least one condition")
+		}
+		for i := range p.All {
+			if err := p.All[i].compile(); err != nil {
+				return err
+			}
+		}
+	}
+	if p.Any != nil {
+		conditions++
+		if len(p.Any) == 0 {
+			return errors.New("any needs at least one condition")
+		}
+		for i := range p.Any {
+			if err := p.Any[i].compile(); err != nil {
+				return err
+			}
+		}
+	}
+	if p.Name != nil {
+		conditions++
+		if err := p.Name.compile(); err != nil {
+			return err
+		}
+	}
+	if p.Entity != nil {
+		conditions++
+		if err := p.Entity.compile(); err != nil {
+			return err
+		}
+	}
+	if p.Tag != nil {
+		conditions++
+		if err := p.Tag.compile(); err != nil {
+			return err
+		}
+	}
+	if p.Duration != nil {
+		conditions++
+		if !p.Duration.isSet() {
+			return errors.New("duration conditions need at least one of gt, gte, lt or lte")
+		}
+	}
+	if p.HttpStatus != nil {
+		conditions++
+		if !p.HttpStatus.isSet() {
+			return errors.New("http_status conditions need at least one of gt, gte, lt or lte")
+		}
+	}
+	if conditions != 1 {
+		return fmt.Errorf("each condition needs exactly one of all, any, name, entity, tag, duration or http_status, found %d", conditions)
+	}
+	return nil
+}
+
+func (p *Predicate) Matches(entityName string, s *st.Span) bool {
+	switch {
+	case p.All != nil:
+		for i := range p.All {
+			if !p.All[i].Matches(entityName, s) {
+				return false
+			}
+		}
+		return true
+	case p.Any != nil:
+		for i := range p.Any {
+			if p.Any[i].Matches(entityName, s) {
+				return true
+			}
+		}
+		return false
+	case p.Name != nil:
+		return p.Name.Matches(s.Name)
+	case p.Entity != nil:
+		return p.Entity.Matches(entityName)
+	case p.Tag != nil:
+		return p.Tag.Matches(s.Tags)
+	case p.Duration != nil:
+		return p.Duration.Matches(s.FinishTime - s.StartTime)
+	case p.HttpStatus != nil:
+		status, ok := toNumber(s.Tags["http.status_code"])
+		return ok && p.HttpStatus.Matches(status)
+	}
+	return false
+}
+
+func (m *StringMatch) compile() error {
+	if m.Regex == "" {
+		if m.Equals == "" {
+			return errors.New("string conditions need equals or regex")
+		}
+		return nil
+	}
+	if m.Equals != "" {
+		return errors.New("only one of equals or regex can be used")
+	}
+	regex, err := regexp.Compile(m.Regex)
+	if err != nil {
+		return err
+	}
+	m.regex = regex
+	return nil
+}
+
+func (m *StringMatch) Matches(val string) bool {
+	if m.regex != nil {
+		return m.regex.MatchString(val)
+	}
+	return m.Equals == val
+}
+
+func (m *NumberMatch) Matches(val float64) bool {
+	return (m.Gt == nil || val > *m.Gt) &&
+		(m.Gte == nil || val >= *m.Gte) &&
+		(m.Lt == nil || val < *m.Lt) &&
+		(m.Lte == nil || val <= *m.Lte)
+}
+
+func (m *NumberMatch) isSet() bool {
+	return m.Gt != nil || m.Gte != nil || m.Lt != nil || m.Lte != nil
+}
+
+func (m *TagMatch) compile() error {
+	if m.Key == "" {
+		return errors.New("tag conditions need a key")
+	}
+	// numbers decoded from yaml come through as ints, tags are float64
+	if number, ok := toNumber(m.Equals); ok {
+		if _, isString := m.Equals.(string); !isString {
+			m.Equals = number
+		}
+	}
+	if m.Regex == "" {
+		return nil
+	}
+	regex, err := regexp.Compile(m.Regex)
+	if err != nil {
+		return err
+	}
+	m.regex = regex
+	return nil
+}
+
+func (m *TagMatch) Matches(tags map[string]interface{}) bool {
+	val, ok := tags[m.Key]
+	if !ok {
+		return false
+	}
+	if m.Equals != nil && !reflect.DeepEqual(m.Equals, val) {
+		return false
+	}
+	if m.regex != nil && !m.regex.MatchString(fmt.Sprint(val)) {
+		return false
+	}
+	if m.NumberMatch.isSet() {
+		number, ok := toNumber(val)
+		if !ok || !m.NumberMatch.Matches(number) {
+			return false
+		}
+	}
+	return true
+}
+
+// toNumber pulls a number out of a tag value, numeric strings (like some
+// agents send status codes as) are parsed.
+func toNumber(val interface{}) (float64, bool) {
+	switch v := val.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	// yaml decodes numbers too big for an int as these
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case string:
+		number, err := strconv.ParseFloat(v, 64)
+		return number, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	st "shared/types"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func mustRuleSet(t *testing.T, rules []Rule) *RuleSet {
+	rs, err := NewRuleSet(rules)
+	assert.Nil(t, err)
+	return rs
+}
+
+func TestRuleSetMatch(t *testing.T) {
+	rules := []Rule{}
+	err := json.Unmarshal([]byte(`[
+		{"name": "error", "match": {"tag": {"key": "error"}}},
+		{"name": "slow-checkout", "match": {"all": [
+			{"entity": {"equals": "checkout"}},
+			{"duration": {"gt": 500}}
+		]}},
+		{"name": "db", "match": {"any": [
+			{"name": {"regex": "^db\\."}},
+			{"tag": {"key": "db.statement", "regex": "(?i)select"}}
+		]}},
+		{"name": "server-error", "match": {"http_status": {"gte": 500, "lt": 600}}}
+	]`), &rules)
+	assert.Nil(t, err)
+	rs := mustRuleSet(t, rules)
+
+	assert.Equal(t, rs.Match("checkout", &st.Span{
+		Name:       "/cart",
+		StartTime:  0,
+		FinishTime: 501,
+		Tags:       map[string]interface{}{"error": true},
+	}), []string{"error", "slow-checkout"}, "should give every matching rule")
+	assert.Equal(t, rs.Match("search", &st.Span{
+		Name:       "/cart",
+		StartTime:  0,
+		FinishTime: 501,
+	}), []string{}, "should only match slow checkouts")
+	assert.Equal(t, rs.Match("search", &st.Span{
+		Name: "db.query",
+	}), []string{"db"}, "should match names by regex")
+	assert.Equal(t, rs.Match("search", &st.Span{
+		Tags: map[string]interface{}{"db.statement": "select * from users"},
+	}), []string{"db"}, "should match tags by regex")
+	assert.Equal(t, rs.Match("search", &st.Span{
+		Tags: map[string]interface{}{"http.status_code": "503"},
+	}), []string{"server-error"}, "should parse status codes sent as strings")
+	assert.Equal(t, rs.Match("search", &st.Span{
+		Tags: map[string]interface{}{"http.status_code": float64(404)},
+	}), []string{}, "should stay inside the status range")
+}
+
+func TestRuleSetYaml(t *testing.T) {
+	rules := []Rule{}
+	err := yaml.Unmarshal([]byte(`
+- name: retries
+  match:
+    tag:
+      key: retry.count
+      gte: 3
+- name: tenant
+  match:
+    tag:
+      key: tenant.id
+      equals: 42
+- name: big-ids
+  match:
+    tag:
+      key: account.id
+      gt: 9300000000000000000
+`), &rules)
+	assert.Nil(t, err)
+	rs := mustRuleSet(t, rules)
+
+	assert.Equal(t, rs.Match("search", &st.Span{
+		Tags: map[string]interface{}{
+			"retry.count": float64(3),
+			"tenant.id":   float64(42),
+		},
+	}), []string{"retries", "tenant"}, "should support yaml rules")
+	assert.Equal(t, rs.Match("search", &st.Span{
+		Tags: map[string]interface{}{"account.id": uint64(9400000000000000000)},
+	}), []string{"big-ids"}, "should compare numbers too big for an int")
+}
+
+func TestNewRuleSetValidation(t *testing.T) {
+	_, err := NewRuleSet([]Rule{{Name: "empty"}})
+	assert.NotNil(t, err, "should need a condition")
+
+	_, err = NewRuleSet([]Rule{{Match: Predicate{Tag: &TagMatch{Key: "error"}}}})
+	assert.NotNil(t, err, "should need a name")
+
+	_, err = NewRuleSet([]Rule{{
+		Name: "two",
+		Match: Predicate{
+			Tag:    &TagMatch{Key: "error"},
+			Entity: &StringMatch{Equals: "checkout"},
+		},
+	}})
+	assert.NotNil(t, err, "should only allow one condition per predicate")
+
+	_, err = NewRuleSet([]Rule{{
+		Name:  "bad-regex",
+		Match: Predicate{Name: &StringMatch{Regex: "("}},
+	}})
+	assert.NotNil(t, err, "should catch bad regexes")
+
+	_, err = NewRuleSet([]Rule{{Name: "empty-all", Match: Predicate{All: []Predicate{}}}})
+	assert.NotNil(t, err, "should need conditions in all")
+	_, err = NewRuleSet([]Rule{{Name: "empty-any", Match: Predicate{Any: []Predicate{}}}})
+	assert.NotNil(t, err, "should need conditions in any")
+
+	_, err = NewRuleSet([]Rule{{Name: "empty-name", Match: Predicate{Name: &StringMatch{}}}})
+	assert.NotNil(t, err, "should need equals or regex")
+
+	_, err = NewRuleSet([]Rule{{Name: "any-duration", Match: Predicate{Duration: &NumberMatch{}}}})
+	assert.NotNil(t, err, "should need a duration bound")
+	_, err = NewRuleSet([]Rule{{Name: "any-status", Match: Predicate{HttpStatus: &NumberMatch{}}}})
+	assert.NotNil(t, err, "should need a status bound")
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	st "shared/types"
+)
+
+// SampledTrace is a trace waiting on the sampler to decide whether it gets
+// kept. Traces without reasons are candidates for the baseline.
+type SampledTrace struct {
+	TraceId    string
+	EntityName string
+	LicenseKey string
+	MessageId  string
+	Reasons    []*st.InterestingTrace
+	// the spans came in without a license key, LicenseKey is the default
+	MissingLicenseKey bool
+	// kept as a normal trace rather than an interesting one
+	Baseline bool
+}
+
+// mergeReasons adds reasons the trace doesn't have yet. When it already has
+// one, the span with the highest score is kept.
+func (t *SampledTrace) mergeReasons(reasons []*st.InterestingTrace) {
+REASONS:
+	for _, reason := range reasons {
+		for i, existing := range t.Reasons {
+			if existing.Reason == reason.Reason {
+				if reason.Score > existing.Score {
+					t.Reasons[i] = reason
+				}
+				continue REASONS
+			}
+		}
+		t.Reasons = append(t.Reasons, reason)
+	}
+}
+
+// reservoir keeps a uniform sample of at most size traces out of everything
+// offered to it. A size of zero or less keeps everything.
+type reservoir struct {
+	size    int
+	seen    int
+	traces  []*SampledTrace
+	kept    map[string]*SampledTrace
+	counted map[string]bool
+}
+
+func newReservoir(size int) *reservoir {
+	return &reservoir{
+		size:    size,
+		traces:  make([]*SampledTrace, 0),
+		kept:    make(map[string]*SampledTrace),
+		counted: make(map[string]bool),
+	}
+}
+
+func (r *reservoir) offer(t *SampledTrace, rng *rand.Rand) {
+	// a trace can show up in more than one message
+	if existing, ok := r.kept[t.TraceId]; ok {
+		existing.mergeReasons(t.Reasons)
+		return
+	}
+	if r.counted[t.TraceId] {
+		return
+	}
+	r.counted[t.TraceId] = true
+	r.seen++
+	if r.size <= 0 || len(r.traces) < r.size {
+		r.traces = append(r.traces, t)
+		r.kept[t.TraceId] = t
+		return
+	}
+	if j := rng.Intn(r.seen); j < r.size {
+		delete(r.kept, r.traces[j].TraceId)
+		r.traces[j] = t
+		r.kept[t.TraceId] = t
+	}
+}
+
+// Sampler does tail based sampling of interesting traces over fixed windows.
+// Each entity gets a budget of traces per window, and each license key a
+// budget across all of its entities, both filled by reservoir sampling so the
+// kept traces are representative of the window. On top of that each entity
+// gets a baseline of normal traces, so there's always something to compare
+// interesting traces against.
+type Sampler struct {
+	EntityBudget     int
+	LicenseKeyBudget int
+	Baseline         int
+	lock             sync.Mutex
+	rng              *rand.Rand
+	interesting      map[string]*reservoir
+	baseline         map[string]*reservoir
+}
+
+func NewSampler(entityBudget int, licenseKeyBudget int, baseline int) *Sampler {
+	return &Sampler{
+		EntityBudget:     entityBudget,
+		LicenseKeyBudget: licenseKeyBudget,
+		Baseline:         baseline,
+		rng:              rand.New(rand.NewSource(time.Now().UnixNano())),
+		interesting:      make(map[string]*reservoir),
+		baseline:         make(map[string]*reservoir),
+	}
+}
+
+func (s *Sampler) Offer(t *SampledTrace) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	reservoirs := s.interesting
+	size := s.EntityBudget
+	if len(t.Reasons) == 0 {
+		if s.Baseline <= 0 {
+			return
+		}
+		reservoirs = s.baseline
+		size = s.Baseline
+	}
+	r, ok := reservoirs[t.EntityName]
+	if !ok {
+		r = newReservoir(size)
+		reservoirs[t.EntityName] = r
+	}
+	r.offer(t, s.rng)
+}
+
+// Flush closes the current window, giving back the traces to keep.
+func (s *Sampler) Flush() []*SampledTrace {
+	// rng is shared with Offer
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	interesting := s.interesting
+	baseline := s.baseline
+	s.interesting = make(map[string]*reservoir)
+	s.baseline = make(map[string]*reservoir)
+
+	// a trace that crosses entities can be kept by each of their
+	// reservoirs, it only needs selecting once
+	byTraceId := make(map[string]*SampledTrace)
+	byLicenseKey := make(map[string][]*SampledTrace)
+	for _, r := range interesting {
+		for _, t := range r.traces {
+			if existing, ok := byTraceId[t.TraceId]; ok {
+				existing.mergeReasons(t.Reasons)
+				continue
+			}
+			byTraceId[t.TraceId] = t
+			byLicenseKey[t.LicenseKey] = append(byLicenseKey[t.LicenseKey], t)
+		}
+	}
+
+	sampled := make([]*SampledTrace, 0)
+	selected := make(map[string]bool)
+	for _, traces := range byLicenseKey {
+		if s.LicenseKeyBudget > 0 && len(traces) > s.LicenseKeyBudget {
+			// each entity's reservoir is already uniform, so a uniform
+			// pick across them keeps the license key sample uniform too
+			s.rng.Shuffle(len(traces), func(i, j int) {
+				traces[i], traces[j] = traces[j], traces[i]
+			})
+			traces = traces[:s.LicenseKeyBudget]
+		}
+		for _, t := range traces {
+			selected[t.TraceId] = true
+			sampled = append(sampled, t)
+		}
+	}
+
+	for entityName, r := range baseline {
+		for _, t := range r.traces {
+			// interesting traces that didn't fit in the budget aren't normal
+			if selected[t.TraceId] || (interesting[entityName] != nil && interesting[entityName].counted[t.TraceId]) {
+				continue
+			}
+			selected[t.TraceId] = true
+			reason := st.NewInterestingTrace(t.TraceId, "baseline")
+			reason.EntityName = t.EntityName
+			t.Reasons = []*st.InterestingTrace{reason}
+			t.Baseline = true
+			sampled = append(sampled, t)
+		}
+	}
+	return sampled
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+
+	st "shared/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func sampledTrace(traceId string, entityName string, licenseKey string, reasons ...string) *SampledTrace {
+	t := &SampledTrace{
+		TraceId:    traceId,
+		EntityName: entityName,
+		LicenseKey: licenseKey,
+		Reasons:    make([]*st.InterestingTrace, 0),
+	}
+	for _, reason := range reasons {
+		t.Reasons = append(t.Reasons, st.NewInterestingTrace(traceId, reason))
+	}
+	return t
+}
+
+func countByEntity(traces []*SampledTrace, reason string) map[string]int {
+	counts := make(map[string]int)
+	for _, t := range traces {
+		if t.Reasons[0].Reason == reason {
+			counts[t.EntityName]++
+		}
+	}
+	return counts
+}
+
+func TestSamplerEntityBudget(t *testing.T) {
+	sampler := NewSampler(10, 0, 0)
+	sampler.rng = rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		sampler.Offer(sampledTrace("checkout"+strconv.Itoa(i), "checkout", "key", "error"))
+	}
+	for i := 0; i < 5; i++ {
+		sampler.Offer(sampledTrace("search"+strconv.Itoa(i), "search", "key", "error"))
+	}
+	assert.Equal(t, countByEntity(sampler.Flush(), "error"), map[string]int{
+		"checkout": 10,
+		"search":   5,
+	}, "should cap each entity at its budget")
+	assert.Empty(t, sampler.Flush(), "should start a fresh window")
+}
+
+func TestSamplerLicenseKeyBudget(t *testing.T) {
+	sampler := NewSampler(10, 15, 0)
+	sampler.rng = rand.New(rand.NewSource(1))
+	for _, entityName := range []string{"checkout", "search", "cart"} {
+		for i := 0; i < 100; i++ {
+			sampler.Offer(sampledTrace(entityName+strconv.Itoa(i), entityName, "key", "error"))
+		}
+	}
+	for i := 0; i < 100; i++ {
+		sampler.Offer(sampledTrace("other"+strconv.Itoa(i), "other", "other-key", "error"))
+	}
+	perKey := make(map[string]int)
+	for _, trace := range sampler.Flush() {
+		perKey[trace.LicenseKey]++
+	}
+	assert.Equal(t, perKey, map[string]int{
+		"key":       15,
+		"other-key": 10,
+	}, "should cap license keys across their entities")
+}
+
+func TestSamplerDuplicateTraces(t *testing.T) {
+	sampler := NewSampler(10, 0, 0)
+	sampler.Offer(sampledTrace("a", "checkout", "key", "error"))
+	sampler.Offer(sampledTrace("a", "checkout", "key", "error", "slow"))
+	sampled := sampler.Flush()
+	assert.Equal(t, len(sampled), 1, "should only keep a trace once")
+	assert.Equal(t, len(sampled[0].Reasons), 2, "should merge reasons")
+}
+
+func TestSamplerTracesAcrossEntities(t *testing.T) {
+	sampler := NewSampler(10, 0, 5)
+	sampler.Offer(sampledTrace("a", "checkout", "key", "error"))
+	sampler.Offer(sampledTrace("a", "search", "key", "slow"))
+	sampler.Offer(sampledTrace("b", "checkout", "key"))
+	sampler.Offer(sampledTrace("b", "search", "key"))
+	sampled := sampler.Flush()
+	assert.Equal(t, len(sampled), 2, "should only select a trace once across entities")
+	for _, trace := range sampled {
+		if trace.TraceId == "a" {
+			assert.Equal(t, len(trace.Reasons), 2, "should merge reasons")
+		}
+	}
+}
+
+func TestSamplerBaseline(t *testing.T) {
+	sampler := NewSampler(1, 0, 2)
+	sampler.rng = rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		sampler.Offer(sampledTrace("normal"+strconv.Itoa(i), "checkout", "key"))
+	}
+	// interesting traces that don't fit the budget aren't normal
+	sampler.Offer(sampledTrace("error1", "checkout", "key", "error"))
+	sampler.Offer(sampledTrace("error2", "checkout", "key", "error"))
+	sampler.Offer(sampledTrace("error2", "checkout", "key"))
+	sampler.Offer(sampledTrace("error1", "checkout", "key"))
+
+	sampled := sampler.Flush()
+	assert.Equal(t, countByEntity(sampled, "error"), map[string]int{"checkout": 1})
+	assert.Equal(t, countByEntity(sampled, "baseline"), map[string]int{"checkout": 2}, "should keep a baseline on top of the budget")
+	for _, trace := range sampled {
+		if trace.Reasons[0].Reason == "baseline" {
+			assert.NotContains(t, []string{"error1", "error2"}, trace.TraceId, "should not use interesting traces as a baseline")
+			assert.True(t, trace.Baseline)
+		}
+	}
+}